@@ -0,0 +1,390 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+)
+
+// placeholder starts every secret in config.example.json, production refuses
+// to start while one is left in place
+const placeholder = "change-me"
+
+// Mail backends, see MailConfig
+const (
+	MailSMTP   = "smtp"
+	MailDir    = "dir"
+	MailMemory = "memory"
+)
+
+// Database dialects, named like the gorm dialects, see DatabaseConfig
+const (
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite3"
+
+	// DialectMemory keeps everything in memory until the app stops, for development only
+	DialectMemory = "memory"
+)
+
+// DatabaseConfig holds the database connection settings. Dialect is DialectPostgres
+// to connect to the server at Host, DialectSQLite to use the file at Path or DialectMemory
+// to run without a database
+type DatabaseConfig struct {
+	Dialect  string `json:"dialect"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// ConnectionInfo builds the connection string expected by gorm.Open
+func (c DatabaseConfig) ConnectionInfo() string {
+	if c.Dialect == DialectSQLite {
+		// wait for the lock instead of failing when the file is being written
+		return fmt.Sprintf("file:%s?_busy_timeout=5000", c.Path)
+	}
+	if c.Password == "" {
+		return fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=disable",
+			c.Host, c.Port, c.User, c.Name)
+	}
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		c.Host, c.Port, c.User, c.Password, c.Name)
+}
+
+// MailConfig selects how emails are delivered. Backend is MailSMTP to send them,
+// MailDir to save them as .eml files in Dir, or MailMemory to only keep them in memory.
+// Production only allows MailSMTP
+type MailConfig struct {
+	Backend string     `json:"backend"`
+	From    string     `json:"from"`
+	Dir     string     `json:"dir"`
+	SMTP    SMTPConfig `json:"smtp"`
+}
+
+// SMTPConfig holds the SMTP server settings used by the MailSMTP backend
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// PasswordConfig is the password policy, see models.PasswordPolicy
+type PasswordConfig struct {
+	MinLength     int    `json:"min_length"`
+	MaxLength     int    `json:"max_length"`
+	BreachedFile  string `json:"breached_file"`
+	DisallowEmail bool   `json:"disallow_email"`
+	BcryptCost    int    `json:"bcrypt_cost"`
+}
+
+// PreviousPepper is a retired pepper, still accepted for password hashes made with it
+type PreviousPepper struct {
+	Version int    `json:"version"`
+	Pepper  string `json:"pepper"`
+}
+
+// PreviousHMACKey is a retired HMAC key, still accepted for tokens hashed with it
+type PreviousHMACKey struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// Config is the application configuration. Values are read from a JSON file
+// and can then be overridden by ECOMMERCE_* environment variables, see Load
+type Config struct {
+	Env      string         `json:"env"`
+	Port     int            `json:"port"`
+	BaseURL  string         `json:"base_url"`
+	Pepper   string         `json:"pepper"`
+	HMACKey  string         `json:"hmac_key"`
+	CSRFKey  string         `json:"csrf_key"`
+	TOTPKey  string         `json:"totp_key"`
+	Database DatabaseConfig `json:"database"`
+	Mail     MailConfig     `json:"mail"`
+	Password PasswordConfig `json:"password"`
+
+	PaymentsWebhookSecret string `json:"payments_webhook_secret"`
+
+	// RequestTimeout is how many seconds a request may take, its
+	// database queries are cancelled once it is over
+	RequestTimeout int `json:"request_timeout"`
+
+	// TOTPIssuer names the site in authenticator apps
+	TOTPIssuer string `json:"totp_issuer"`
+
+	// Pepper and HMACKey are rotated by moving them to the previous lists
+	// and setting new ones with a new PepperVersion and HMACKeyID
+	PepperVersion    int               `json:"pepper_version"`
+	PreviousPeppers  []PreviousPepper  `json:"previous_peppers"`
+	HMACKeyID        string            `json:"hmac_key_id"`
+	PreviousHMACKeys []PreviousHMACKey `json:"previous_hmac_keys"`
+}
+
+// IsProd reports whether the app runs in production mode
+func (c Config) IsProd() bool {
+	return c.Env == EnvProduction
+}
+
+// Addr is the address the HTTP server listens on
+func (c Config) Addr() string {
+	return fmt.Sprintf(":%d", c.Port)
+}
+
+// Default is the development configuration. Its secrets are public,
+// which is why Validate refuses them in production
+func Default() Config {
+	return Config{
+		Env:     EnvDevelopment,
+		Port:    3000,
+		BaseURL: "http://localhost:3000",
+		Pepper:  "6J53aQog5tQPaJPT",
+		HMACKey: "6hMXiDnQoH8Ec7KQ",
+		CSRFKey: "4m6D9fKc2qXw8ZtR1yVb7NpL3sHj5GeU",
+		TOTPKey: "Qe8vT2nW5kZr7YbH3xLm9PcS4dFj6GaU",
+		Database: DatabaseConfig{
+			Dialect:  DialectPostgres,
+			Host:     "localhost",
+			Port:     5432,
+			User:     "postgres",
+			Password: "postgres",
+			Name:     "ecommerce_dev",
+			Path:     "ecommerce_dev.db",
+		},
+		Mail: MailConfig{
+			Backend: MailDir,
+			From:    "E-Commerce <no-reply@localhost>",
+			Dir:     ".mail",
+			SMTP: SMTPConfig{
+				Port: 587,
+			},
+		},
+		Password: PasswordConfig{
+			MinLength:     8,
+			MaxLength:     56,
+			DisallowEmail: true,
+			BcryptCost:    10,
+		},
+		PaymentsWebhookSecret: "dev-webhook-secret",
+		RequestTimeout:        10,
+		TOTPIssuer:            "E-Commerce",
+		PepperVersion:         1,
+		HMACKeyID:             "1",
+	}
+}
+
+// Load starts from Default, applies the JSON file at path if it exists,
+// then applies environment overrides and validates the result.
+// A missing file is not an error so development works without one
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("config: parsing %s: %v", path, err)
+		}
+	case !os.IsNotExist(err):
+		return cfg, err
+	}
+
+	if err := applyEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// Validate makes sure the configuration is usable. In production it
+// refuses to start when any secret was left at its development default
+func (c Config) Validate() error {
+	if c.Env != EnvDevelopment && c.Env != EnvProduction {
+		return fmt.Errorf("config: env must be %q or %q, got %q", EnvDevelopment, EnvProduction, c.Env)
+	}
+	if err := c.validateKeys(); err != nil {
+		return err
+	}
+	if len(c.CSRFKey) != 32 {
+		return fmt.Errorf("config: csrf_key must be exactly 32 bytes long, got %d", len(c.CSRFKey))
+	}
+	// the TOTP key is an AES-256 key
+	if len(c.TOTPKey) != 32 {
+		return fmt.Errorf("config: totp_key must be exactly 32 bytes long, got %d", len(c.TOTPKey))
+	}
+	// bcrypt only hashes the first 72 bytes and accepts costs from 4 to 31
+	pw := c.Password
+	if pw.MinLength < 1 || pw.MaxLength < pw.MinLength || pw.MaxLength > 72 {
+		return fmt.Errorf("config: password lengths must satisfy 1 <= min_length <= max_length <= 72, got %d and %d",
+			pw.MinLength, pw.MaxLength)
+	}
+	// the pepper is appended to the password before hashing, so the longest
+	// password must still fit next to every pepper that can be used to check it
+	peppers := append([]PreviousPepper{{Version: c.PepperVersion, Pepper: c.Pepper}}, c.PreviousPeppers...)
+	for _, p := range peppers {
+		if pw.MaxLength+len(p.Pepper) > 72 {
+			return fmt.Errorf("config: password.max_length plus the length of pepper version %d must be at most 72 bytes, got %d",
+				p.Version, pw.MaxLength+len(p.Pepper))
+		}
+	}
+	if pw.BcryptCost < 4 || pw.BcryptCost > 31 {
+		return fmt.Errorf("config: password.bcrypt_cost must be between 4 and 31, got %d", pw.BcryptCost)
+	}
+	switch c.Database.Dialect {
+	case DialectPostgres:
+	case DialectSQLite:
+		if c.Database.Path == "" {
+			return fmt.Errorf("config: database.path is required by the %q dialect", DialectSQLite)
+		}
+	case DialectMemory:
+		if c.IsProd() {
+			return fmt.Errorf("config: the %q database dialect is for development only", DialectMemory)
+		}
+	default:
+		return fmt.Errorf("config: database.dialect must be %q, %q or %q, got %q",
+			DialectPostgres, DialectSQLite, DialectMemory, c.Database.Dialect)
+	}
+	if c.RequestTimeout < 1 {
+		return fmt.Errorf("config: request_timeout must be at least 1 second, got %d", c.RequestTimeout)
+	}
+	switch c.Mail.Backend {
+	case MailSMTP:
+		if c.Mail.SMTP.Host == "" {
+			return fmt.Errorf("config: mail.smtp.host is required by the %q mail backend", MailSMTP)
+		}
+	case MailDir, MailMemory:
+		if c.IsProd() {
+			return fmt.Errorf("config: mail.backend must be %q in production, got %q", MailSMTP, c.Mail.Backend)
+		}
+	default:
+		return fmt.Errorf("config: mail.backend must be %q, %q or %q, got %q", MailSMTP, MailDir, MailMemory, c.Mail.Backend)
+	}
+	if !c.IsProd() {
+		return nil
+	}
+
+	def := Default()
+	secrets := []struct {
+		name, value, defaultValue string
+	}{
+		{"pepper", c.Pepper, def.Pepper},
+		{"hmac_key", c.HMACKey, def.HMACKey},
+		{"csrf_key", c.CSRFKey, def.CSRFKey},
+		{"totp_key", c.TOTPKey, def.TOTPKey},
+		{"database.password", c.Database.Password, def.Database.Password},
+		{"payments_webhook_secret", c.PaymentsWebhookSecret, def.PaymentsWebhookSecret},
+	}
+	for _, secret := range secrets {
+		// a SQLite file has no password
+		if secret.name == "database.password" && c.Database.Dialect == DialectSQLite {
+			continue
+		}
+		if secret.value == "" || secret.value == secret.defaultValue || strings.HasPrefix(secret.value, placeholder) {
+			return fmt.Errorf("config: %s must be changed from its default in production", secret.name)
+		}
+	}
+	if strings.HasPrefix(c.Mail.SMTP.Password, placeholder) {
+		return fmt.Errorf("config: mail.smtp.password must be changed from its default in production")
+	}
+	return nil
+}
+
+// validateKeys makes sure pepper versions and HMAC key IDs are unique,
+// so every stored hash points at exactly one secret
+func (c Config) validateKeys() error {
+	if c.PepperVersion < 1 {
+		return fmt.Errorf("config: pepper_version must be 1 or more, got %d", c.PepperVersion)
+	}
+	versions := map[int]bool{c.PepperVersion: true}
+	for _, p := range c.PreviousPeppers {
+		if p.Version < 1 || versions[p.Version] {
+			return fmt.Errorf("config: previous pepper version %d is invalid or used twice", p.Version)
+		}
+		if p.Pepper == "" {
+			return fmt.Errorf("config: previous pepper version %d is empty", p.Version)
+		}
+		versions[p.Version] = true
+	}
+
+	keys := append([]PreviousHMACKey{{ID: c.HMACKeyID, Key: c.HMACKey}}, c.PreviousHMACKeys...)
+	ids := map[string]bool{}
+	for _, k := range keys {
+		if k.ID == "" || strings.Contains(k.ID, "$") || ids[k.ID] {
+			return fmt.Errorf("config: HMAC key ID %q is empty, contains $ or is used twice", k.ID)
+		}
+		if k.Key == "" {
+			return fmt.Errorf("config: HMAC key %q is empty", k.ID)
+		}
+		ids[k.ID] = true
+	}
+	return nil
+}
+
+// applyEnv overrides the configuration with any ECOMMERCE_* environment variables that are set
+func applyEnv(cfg *Config) error {
+	stringVars := map[string]*string{
+		"ECOMMERCE_ENV":                     &cfg.Env,
+		"ECOMMERCE_BASE_URL":                &cfg.BaseURL,
+		"ECOMMERCE_PEPPER":                  &cfg.Pepper,
+		"ECOMMERCE_HMAC_KEY":                &cfg.HMACKey,
+		"ECOMMERCE_HMAC_KEY_ID":             &cfg.HMACKeyID,
+		"ECOMMERCE_CSRF_KEY":                &cfg.CSRFKey,
+		"ECOMMERCE_TOTP_KEY":                &cfg.TOTPKey,
+		"ECOMMERCE_TOTP_ISSUER":             &cfg.TOTPIssuer,
+		"ECOMMERCE_PAYMENTS_WEBHOOK_SECRET": &cfg.PaymentsWebhookSecret,
+		"ECOMMERCE_DB_DIALECT":              &cfg.Database.Dialect,
+		"ECOMMERCE_DB_HOST":                 &cfg.Database.Host,
+		"ECOMMERCE_DB_USER":                 &cfg.Database.User,
+		"ECOMMERCE_DB_PASSWORD":             &cfg.Database.Password,
+		"ECOMMERCE_DB_NAME":                 &cfg.Database.Name,
+		"ECOMMERCE_DB_PATH":                 &cfg.Database.Path,
+		"ECOMMERCE_MAIL_BACKEND":            &cfg.Mail.Backend,
+		"ECOMMERCE_MAIL_FROM":               &cfg.Mail.From,
+		"ECOMMERCE_MAIL_DIR":                &cfg.Mail.Dir,
+		"ECOMMERCE_SMTP_HOST":               &cfg.Mail.SMTP.Host,
+		"ECOMMERCE_SMTP_USERNAME":           &cfg.Mail.SMTP.Username,
+		"ECOMMERCE_SMTP_PASSWORD":           &cfg.Mail.SMTP.Password,
+		"ECOMMERCE_PASSWORD_BREACHED_FILE":  &cfg.Password.BreachedFile,
+	}
+	for name, dst := range stringVars {
+		if value, ok := os.LookupEnv(name); ok {
+			*dst = value
+		}
+	}
+
+	intVars := map[string]*int{
+		"ECOMMERCE_PORT":                &cfg.Port,
+		"ECOMMERCE_REQUEST_TIMEOUT":     &cfg.RequestTimeout,
+		"ECOMMERCE_DB_PORT":             &cfg.Database.Port,
+		"ECOMMERCE_SMTP_PORT":           &cfg.Mail.SMTP.Port,
+		"ECOMMERCE_PASSWORD_MIN_LENGTH": &cfg.Password.MinLength,
+		"ECOMMERCE_PASSWORD_MAX_LENGTH": &cfg.Password.MaxLength,
+		"ECOMMERCE_BCRYPT_COST":         &cfg.Password.BcryptCost,
+		"ECOMMERCE_PEPPER_VERSION":      &cfg.PepperVersion,
+	}
+	for name, dst := range intVars {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("config: %s must be a number, got %q", name, value)
+		}
+		*dst = n
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package context
+
+import (
+	"context"
+
+	"ecommerce/models"
+)
+
+// privateKey keeps other packages from reading or overwriting our context values
+type privateKey string
+
+const (
+	userKey    privateKey = "user"
+	sessionKey privateKey = "session"
+)
+
+// WithUser returns a copy of ctx carrying the signed in user
+func WithUser(ctx context.Context, user *models.User) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// User returns the signed in user stored by WithUser, or nil if there is none
+func User(ctx context.Context) *models.User {
+	if temp := ctx.Value(userKey); temp != nil {
+		if user, ok := temp.(*models.User); ok {
+			return user
+		}
+	}
+	return nil
+}
+
+// WithSession returns a copy of ctx carrying the session the user signed in with
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+// Session returns the session stored by WithSession, or nil if there is none
+func Session(ctx context.Context) *models.Session {
+	if temp := ctx.Value(sessionKey); temp != nil {
+		if session, ok := temp.(*models.Session); ok {
+			return session
+		}
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+package controllers
+
+import (
+	"ecommerce/context"
+	"ecommerce/models"
+	"ecommerce/payments"
+	"ecommerce/views"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// NewAdmin creates the controller of the /admin area. Access is checked by
+// middleware.RequirePermission on the routes in main.go, not by the handlers
+func NewAdmin(us models.UserService, ps models.ProductService, os models.OrderService,
+	is models.InventoryService, gw payments.Gateway) *Admin {
+	return &Admin{
+		UsersView:     views.NewView("admin", "admin/users"),
+		ProductsView:  views.NewView("admin", "admin/products"),
+		ProductView:   views.NewView("admin", "admin/product"),
+		OrdersView:    views.NewView("admin", "admin/orders"),
+		OrderView:     views.NewView("admin", "admin/order"),
+		InventoryView: views.NewView("admin", "admin/inventory"),
+		us:            us,
+		ps:            ps,
+		os:            os,
+		is:            is,
+		gw:            gw,
+	}
+}
+
+type Admin struct {
+	UsersView     *views.View
+	ProductsView  *views.View
+	ProductView   *views.View
+	OrdersView    *views.View
+	OrderView     *views.View
+	InventoryView *views.View
+	us            models.UserService
+	ps            models.ProductService
+	os            models.OrderService
+	is            models.InventoryService
+	gw            payments.Gateway
+}
+
+// AdminUsersData is what the admin users view expects in Yield
+type AdminUsersData struct {
+	Users     []models.User
+	Roles     []string
+	CurrentID uint
+}
+
+type RoleForm struct {
+	Role string `schema:"role"`
+}
+
+// ProductForm is used to create and edit products, Price is in cents
+type ProductForm struct {
+	Name        string `schema:"name"`
+	SKU         string `schema:"sku"`
+	Slug        string `schema:"slug"`
+	Description string `schema:"description"`
+	Price       int    `schema:"price"`
+}
+
+type StatusForm struct {
+	Status string `schema:"status"`
+}
+
+type StockForm struct {
+	SKU    string `schema:"sku"`
+	OnHand int    `schema:"on_hand"`
+}
+
+// errOwnRole is returned when admins try to change their own role,
+// which could leave the store without any admin
+var errOwnRole = publicError("You can not change your own role")
+
+// Users lists every user with their role
+//
+// GET /admin/users
+func (a *Admin) Users(w http.ResponseWriter, r *http.Request) {
+	a.renderUsers(w, r, views.Data{})
+}
+
+// SetRole changes the role of a user
+//
+// POST /admin/users/:id/role
+func (a *Admin) SetRole(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form RoleForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.renderUsers(w, r, vd)
+		return
+	}
+
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	if user.ID == context.User(r.Context()).ID {
+		vd.SetAlert(errOwnRole)
+		a.renderUsers(w, r, vd)
+		return
+	}
+
+	user.Role = form.Role
+	if err := a.us.UpdateContext(r.Context(), user); err != nil {
+		vd.SetAlert(err)
+		a.renderUsers(w, r, vd)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
+
+// Products lists the catalog
+//
+// GET /admin/products
+func (a *Admin) Products(w http.ResponseWriter, r *http.Request) {
+	a.renderProducts(w, r, views.Data{})
+}
+
+// NewProduct displays the form to add a product
+//
+// GET /admin/products/new
+func (a *Admin) NewProduct(w http.ResponseWriter, r *http.Request) {
+	a.ProductView.Render(w, r, &models.Product{})
+}
+
+// CreateProduct adds a product to the catalog
+//
+// POST /admin/products
+func (a *Admin) CreateProduct(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var product models.Product
+	vd.Yield = &product
+	if err := parseProductForm(r, &product); err != nil {
+		vd.SetAlert(err)
+		a.ProductView.Render(w, r, vd)
+		return
+	}
+
+	if err := a.ps.Create(&product); err != nil {
+		vd.SetAlert(err)
+		a.ProductView.Render(w, r, vd)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/products", http.StatusFound)
+}
+
+// EditProduct displays the form to edit a product
+//
+// GET /admin/products/:id
+func (a *Admin) EditProduct(w http.ResponseWriter, r *http.Request) {
+	product, err := a.productByID(w, r)
+	if err != nil {
+		return
+	}
+	a.ProductView.Render(w, r, product)
+}
+
+// UpdateProduct saves the changes made to a product
+//
+// POST /admin/products/:id
+func (a *Admin) UpdateProduct(w http.ResponseWriter, r *http.Request) {
+	product, err := a.productByID(w, r)
+	if err != nil {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = product
+	if err := parseProductForm(r, product); err != nil {
+		vd.SetAlert(err)
+		a.ProductView.Render(w, r, vd)
+		return
+	}
+
+	if err := a.ps.Update(product); err != nil {
+		vd.SetAlert(err)
+		a.ProductView.Render(w, r, vd)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/products", http.StatusFound)
+}
+
+// DeleteProduct removes a product from the catalog, past orders keep their copy of it
+//
+// POST /admin/products/:id/delete
+func (a *Admin) DeleteProduct(w http.ResponseWriter, r *http.Request) {
+	product, err := a.productByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if err := a.ps.Delete(product.ID); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		a.renderProducts(w, r, vd)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/products", http.StatusFound)
+}
+
+// Orders lists the orders of every user, newest first
+//
+// GET /admin/orders
+func (a *Admin) Orders(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	orders, err := a.os.All()
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = orders
+	a.OrdersView.Render(w, r, vd)
+}
+
+// Order displays an order with the statuses it can move to
+//
+// GET /admin/orders/:id
+func (a *Admin) Order(w http.ResponseWriter, r *http.Request) {
+	order, err := a.orderByID(w, r)
+	if err != nil {
+		return
+	}
+	a.OrderView.Render(w, r, order)
+}
+
+// SetOrderStatus moves an order to another status. Cancelling or refunding
+// an order that was paid refunds its payment once the status was changed,
+// so an order moved by two staff members at once is refunded only once
+//
+// POST /admin/orders/:id/status
+func (a *Admin) SetOrderStatus(w http.ResponseWriter, r *http.Request) {
+	order, err := a.orderByID(w, r)
+	if err != nil {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = order
+	var form StatusForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.OrderView.Render(w, r, vd)
+		return
+	}
+
+	if !order.CanMoveTo(form.Status) {
+		vd.SetAlert(models.ErrTransitionInvalid)
+		a.OrderView.Render(w, r, vd)
+		return
+	}
+
+	if err := a.os.Transition(order, form.Status); err != nil {
+		vd.SetAlert(err)
+		a.OrderView.Render(w, r, vd)
+		return
+	}
+
+	refund := form.Status == models.OrderCancelled || form.Status == models.OrderRefunded
+	if refund && order.PaymentID != "" {
+		if _, err := a.gw.Refund(order.PaymentID, order.Total); err != nil {
+			vd.SetAlert(err)
+			a.OrderView.Render(w, r, vd)
+			return
+		}
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/admin/orders/%d", order.ID), http.StatusFound)
+}
+
+// Inventory lists the stock of every SKU
+//
+// GET /admin/inventory
+func (a *Admin) Inventory(w http.ResponseWriter, r *http.Request) {
+	a.renderInventory(w, r, views.Data{})
+}
+
+// SetStock sets how many units of a SKU are on hand, creating its stock if needed
+//
+// POST /admin/inventory
+func (a *Admin) SetStock(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form StockForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.renderInventory(w, r, vd)
+		return
+	}
+
+	stock := models.Stock{
+		SKU:    form.SKU,
+		OnHand: form.OnHand,
+	}
+	if err := a.is.Set(&stock); err != nil {
+		vd.SetAlert(err)
+		a.renderInventory(w, r, vd)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/inventory", http.StatusFound)
+}
+
+func (a *Admin) renderUsers(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	users, err := a.us.All()
+	if err != nil && vd.Alert == nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = AdminUsersData{
+		Users:     users,
+		Roles:     models.Roles,
+		CurrentID: context.User(r.Context()).ID,
+	}
+	a.UsersView.Render(w, r, vd)
+}
+
+func (a *Admin) renderProducts(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	products, err := a.ps.All()
+	if err != nil && vd.Alert == nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = products
+	a.ProductsView.Render(w, r, vd)
+}
+
+func (a *Admin) renderInventory(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	stocks, err := a.is.All()
+	if err != nil && vd.Alert == nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = stocks
+	a.InventoryView.Render(w, r, vd)
+}
+
+// parseProductForm copies the product form onto product
+func parseProductForm(r *http.Request, product *models.Product) error {
+	var form ProductForm
+	if err := parseForm(r, &form); err != nil {
+		return err
+	}
+	product.Name = form.Name
+	product.SKU = form.SKU
+	product.Slug = form.Slug
+	product.Description = form.Description
+	product.Price = form.Price
+	return nil
+}
+
+// userByID, productByID and orderByID parse the id route variable and look up the record.
+// If an error is returned, the response has already been written
+func (a *Admin) userByID(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	id, err := idFromVars(r, "id")
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, err
+	}
+	user, err := a.us.ByIDContext(r.Context(), id)
+	return user, lookupError(w, err, "User not found")
+}
+
+func (a *Admin) productByID(w http.ResponseWriter, r *http.Request) (*models.Product, error) {
+	id, err := idFromVars(r, "id")
+	if err != nil {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return nil, err
+	}
+	product, err := a.ps.ByID(id)
+	return product, lookupError(w, err, "Product not found")
+}
+
+func (a *Admin) orderByID(w http.ResponseWriter, r *http.Request) (*models.Order, error) {
+	id, err := idFromVars(r, "id")
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return nil, err
+	}
+	order, err := a.os.ByID(id)
+	return order, lookupError(w, err, "Order not found")
+}
+
+// lookupError writes the response for a failed lookup, notFound is the message for ErrNotFound
+func lookupError(w http.ResponseWriter, err error, notFound string) error {
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		http.Error(w, notFound, http.StatusNotFound)
+	default:
+		log.Println(err)
+		http.Error(w, views.AlertMsgGeneric, http.StatusInternalServerError)
+	}
+	return err
+}
@@ -0,0 +1,661 @@
+package controllers
+
+import (
+	"ecommerce/context"
+	"ecommerce/models"
+	"ecommerce/payments"
+	"ecommerce/throttle"
+	"ecommerce/views"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// NewAPI creates the JSON API controller. Clients authenticate by sending the
+// session token returned by signup and login as "Authorization: Bearer <token>",
+// routes needing a user are wrapped with middleware.RequireUser in main.go
+func NewAPI(us models.UserService, ss models.SessionService, ps models.ProductService,
+	cs models.CartService, os models.OrderService, txr Transactor, gw payments.Gateway, mailer Mailer,
+	limiter *throttle.Limiter) *API {
+	return &API{
+		us:      us,
+		ss:      ss,
+		ps:      ps,
+		cs:      cs,
+		os:      os,
+		txr:     txr,
+		gw:      gw,
+		mailer:  mailer,
+		limiter: limiter,
+	}
+}
+
+type API struct {
+	us      models.UserService
+	ss      models.SessionService
+	ps      models.ProductService
+	cs      models.CartService
+	os      models.OrderService
+	txr     Transactor
+	gw      payments.Gateway
+	mailer  Mailer
+	limiter *throttle.Limiter
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiUser struct {
+	ID            uint   `json:"id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// apiTOTPRequired is sent by Login when the account has two-factor authentication,
+// LoginToken is then sent to LoginTOTP along with the code
+type apiTOTPRequired struct {
+	Error      string `json:"error"`
+	LoginToken string `json:"login_token"`
+}
+
+type apiSession struct {
+	Token string  `json:"token"`
+	User  apiUser `json:"user"`
+}
+
+type apiProduct struct {
+	ID          uint   `json:"id"`
+	Name        string `json:"name"`
+	SKU         string `json:"sku"`
+	Slug        string `json:"slug"`
+	Description string `json:"description"`
+	Price       int    `json:"price"`
+}
+
+type apiCartItem struct {
+	Product  apiProduct `json:"product"`
+	Quantity int        `json:"quantity"`
+	Subtotal int        `json:"subtotal"`
+}
+
+type apiCart struct {
+	Items []apiCartItem `json:"items"`
+	Total int           `json:"total"`
+}
+
+type apiOrderItem struct {
+	ProductID uint   `json:"product_id"`
+	Name      string `json:"name"`
+	SKU       string `json:"sku"`
+	Price     int    `json:"price"`
+	Quantity  int    `json:"quantity"`
+	Subtotal  int    `json:"subtotal"`
+}
+
+type apiOrder struct {
+	ID        uint           `json:"id"`
+	Status    string         `json:"status"`
+	Total     int            `json:"total"`
+	CreatedAt time.Time      `json:"created_at"`
+	Items     []apiOrderItem `json:"items"`
+}
+
+type apiCartItemForm struct {
+	ProductID uint `json:"product_id"`
+	Quantity  int  `json:"quantity"`
+}
+
+type apiCheckoutForm struct {
+	PaymentSource string `json:"payment_source"`
+}
+
+// Signup creates a new account and returns its token
+//
+// POST /api/v1/signup
+func (a *API) Signup(w http.ResponseWriter, r *http.Request) {
+	var form struct {
+		Name     string `json:"name"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := parseJSON(r, &form); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	user := models.User{
+		Name:     form.Name,
+		Email:    form.Email,
+		Password: form.Password,
+	}
+	if err := a.us.CreateContext(r.Context(), &user); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	if err := sendVerification(a.us, a.mailer, &user); err != nil {
+		log.Println(err)
+	}
+
+	session, err := newSession(a.ss, r, &user)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, apiSession{
+		Token: session.Token,
+		User:  newAPIUser(&user),
+	})
+}
+
+// Login authenticates the user and returns their token
+//
+// POST /api/v1/login
+func (a *API) Login(w http.ResponseWriter, r *http.Request) {
+	var form struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := parseJSON(r, &form); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	user, err := authenticate(a.us, a.limiter, r, form.Email, form.Password)
+	if err == models.ErrTOTPRequired {
+		token, err := a.us.LoginToken(user)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusUnauthorized, apiTOTPRequired{
+			Error:      models.ErrTOTPRequired.Public(),
+			LoginToken: token,
+		})
+		return
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	session, err := newSession(a.ss, r, user)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiSession{
+		Token: session.Token,
+		User:  newAPIUser(user),
+	})
+}
+
+// LoginTOTP finishes the login of a user with two-factor authentication
+// and returns their token
+//
+// POST /api/v1/login/totp
+func (a *API) LoginTOTP(w http.ResponseWriter, r *http.Request) {
+	var form struct {
+		LoginToken string `json:"login_token"`
+		Code       string `json:"code"`
+	}
+	if err := parseJSON(r, &form); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	user, err := a.us.ByLoginToken(form.LoginToken)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	err = throttleTOTP(a.limiter, r, func() error {
+		return a.us.VerifyTOTPContext(r.Context(), user, form.Code)
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	session, err := newSession(a.ss, r, user)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiSession{
+		Token: session.Token,
+		User:  newAPIUser(user),
+	})
+}
+
+// Logout deletes the session of the token used, so it can no longer be used
+//
+// POST /api/v1/logout
+func (a *API) Logout(w http.ResponseWriter, r *http.Request) {
+	if err := a.ss.Delete(context.Session(r.Context()).ID); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Me returns the authenticated user
+//
+// GET /api/v1/me
+func (a *API) Me(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	writeJSON(w, http.StatusOK, newAPIUser(user))
+}
+
+// ResendVerification emails a new verification link to the authenticated user
+//
+// POST /api/v1/verify/resend
+func (a *API) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if !user.Verified() {
+		if err := sendVerification(a.us, a.mailer, user); err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Products lists the catalog
+//
+// GET /api/v1/products
+func (a *API) Products(w http.ResponseWriter, r *http.Request) {
+	products, err := a.ps.All()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	res := make([]apiProduct, 0, len(products))
+	for _, product := range products {
+		res = append(res, newAPIProduct(&product))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Product returns a single product
+//
+// GET /api/v1/products/:id
+func (a *API) Product(w http.ResponseWriter, r *http.Request) {
+	id, err := idFromVars(r, "id")
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	product, err := a.ps.ByID(id)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIProduct(product))
+}
+
+// Cart returns the authenticated user's cart
+//
+// GET /api/v1/cart
+func (a *API) Cart(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	cart, err := a.cs.ByUserID(user.ID)
+	if err == models.ErrNotFound {
+		cart, err = &models.Cart{}, nil
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPICart(cart))
+}
+
+// AddCartItem adds a product to the authenticated user's cart
+//
+// POST /api/v1/cart/items
+func (a *API) AddCartItem(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var form apiCartItemForm
+	if err := parseJSON(r, &form); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if form.Quantity == 0 {
+		form.Quantity = 1
+	}
+
+	cart, err := a.cs.ByUserID(user.ID)
+	if err == models.ErrNotFound {
+		cart = &models.Cart{UserID: user.ID}
+		err = a.cs.Create(cart)
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	item := models.CartItem{
+		CartID:    cart.ID,
+		ProductID: form.ProductID,
+		Quantity:  form.Quantity,
+	}
+	if err := a.cs.AddItem(&item); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	a.Cart(w, r)
+}
+
+// UpdateCartItem sets the quantity of a product in the cart, zero removes it
+//
+// PUT /api/v1/cart/items/:product_id
+func (a *API) UpdateCartItem(w http.ResponseWriter, r *http.Request) {
+	a.changeCartItem(w, r, true)
+}
+
+// RemoveCartItem takes a product out of the cart
+//
+// DELETE /api/v1/cart/items/:product_id
+func (a *API) RemoveCartItem(w http.ResponseWriter, r *http.Request) {
+	a.changeCartItem(w, r, false)
+}
+
+// Orders lists the authenticated user's orders
+//
+// GET /api/v1/orders
+func (a *API) Orders(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	orders, err := a.os.ByUserID(user.ID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	res := make([]apiOrder, 0, len(orders))
+	for _, order := range orders {
+		res = append(res, newAPIOrder(&order))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Order returns one of the authenticated user's orders
+//
+// GET /api/v1/orders/:id
+func (a *API) Order(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	id, err := idFromVars(r, "id")
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	order, err := a.os.ByID(id)
+	if err == nil && order.UserID != user.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIOrder(order))
+}
+
+// CreateOrder checks out the authenticated user's cart
+//
+// POST /api/v1/orders
+func (a *API) CreateOrder(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var form apiCheckoutForm
+	if err := parseJSON(r, &form); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	cart, err := a.cs.ByUserID(user.ID)
+	if err == models.ErrNotFound {
+		err = models.ErrOrderEmpty
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	order, err := checkout(r.Context(), a.txr, a.gw, user, cart, form.PaymentSource)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAPIOrder(order))
+}
+
+// NotFound answers unknown API routes with a JSON error instead of the HTML 404 page
+func (a *API) NotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, models.ErrNotFound)
+}
+
+// changeCartItem updates the quantity of the product in the route, or removes it
+func (a *API) changeCartItem(w http.ResponseWriter, r *http.Request, update bool) {
+	user := context.User(r.Context())
+
+	productID, err := idFromVars(r, "product_id")
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	item := models.CartItem{
+		ProductID: productID,
+	}
+	if update {
+		var form apiCartItemForm
+		if err := parseJSON(r, &form); err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		item.Quantity = form.Quantity
+	}
+
+	cart, err := a.cs.ByUserID(user.ID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	item.CartID = cart.ID
+
+	if update {
+		err = a.cs.UpdateItem(&item)
+	} else {
+		err = a.cs.RemoveItem(&item)
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	a.Cart(w, r)
+}
+
+// maxWebhookBytes limits the size of the payloads accepted by PaymentsWebhook
+const maxWebhookBytes = 64 << 10
+
+// PaymentsWebhook receives the events the payment gateway sends about charges,
+// signed with payments.SignatureHeader. Events older than payments.WebhookTolerance
+// are refused so captured requests can not be replayed later. Orders whose charge
+// was refunded at the gateway are marked as refunded, events about unknown charges
+// and event types we do not handle are acknowledged and ignored so the gateway
+// stops retrying
+//
+// POST /api/v1/payments/webhook
+func (a *API) PaymentsWebhook(w http.ResponseWriter, r *http.Request) {
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBytes))
+	if err != nil {
+		writeJSONError(w, errInvalidJSON)
+		return
+	}
+	event, err := a.gw.VerifyWebhook(payload, r.Header.Get(payments.SignatureHeader))
+	if err == payments.ErrSignatureInvalid || err == payments.ErrEventExpired {
+		writeJSONError(w, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, errInvalidJSON)
+		return
+	}
+
+	switch event.Type {
+	case payments.EventChargeRefunded:
+		order, err := a.os.ByPaymentID(event.ChargeID)
+		if err == models.ErrNotFound {
+			break
+		}
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		if !order.CanMoveTo(models.OrderRefunded) {
+			break
+		}
+		if err := a.os.Transition(order, models.OrderRefunded); err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// idFromVars parses a numeric route variable, returning models.ErrNotFound if it is invalid
+func idFromVars(r *http.Request, name string) (uint, error) {
+	id, err := strconv.ParseUint(mux.Vars(r)[name], 10, 64)
+	if err != nil {
+		return 0, models.ErrNotFound
+	}
+	return uint(id), nil
+}
+
+// parseJSON decodes the request body into dst, the JSON equivalent of parseForm
+func parseJSON(r *http.Request, dst interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(dst); err != nil {
+		return errInvalidJSON
+	}
+	return nil
+}
+
+// errInvalidJSON is returned by parseJSON, its Public message is sent to the client
+var errInvalidJSON = publicError("Request body must be valid JSON")
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError works like views.Data.SetAlert: errors implementing
+// views.PublicError are sent with their Public message and any other
+// error is logged and replaced by a generic message
+func writeJSONError(w http.ResponseWriter, err error) {
+	pErr, ok := err.(views.PublicError)
+	if !ok {
+		log.Println(err)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: views.AlertMsgGeneric})
+		return
+	}
+	writeJSON(w, apiStatus(err), apiError{Error: pErr.Public()})
+}
+
+// apiStatus maps public errors to HTTP status codes,
+// anything not listed is a validation error
+func apiStatus(err error) int {
+	switch err {
+	case models.ErrNotFound:
+		return http.StatusNotFound
+	case models.ErrCredentialsInvalid, models.ErrTOTPInvalid, models.ErrTokenInvalid:
+		return http.StatusUnauthorized
+	case models.ErrAccountLocked, errTooManyAttempts:
+		return http.StatusTooManyRequests
+	case models.ErrEmailTaken, models.ErrSKUTaken, models.ErrSlugTaken,
+		models.ErrTransitionInvalid, models.ErrOutOfStock, models.ErrReservationExpired,
+		models.ErrOrderChanged, models.ErrCartCheckedOut:
+		return http.StatusConflict
+	case payments.ErrCardDeclined:
+		return http.StatusPaymentRequired
+	case models.ErrEmailNotVerified:
+		return http.StatusForbidden
+	case errInvalidJSON, payments.ErrSignatureInvalid, payments.ErrEventExpired:
+		return http.StatusBadRequest
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
+
+func newAPIUser(user *models.User) apiUser {
+	return apiUser{
+		ID:            user.ID,
+		Name:          user.Name,
+		Email:         user.Email,
+		EmailVerified: user.Verified(),
+	}
+}
+
+func newAPIProduct(product *models.Product) apiProduct {
+	return apiProduct{
+		ID:          product.ID,
+		Name:        product.Name,
+		SKU:         product.SKU,
+		Slug:        product.Slug,
+		Description: product.Description,
+		Price:       product.Price,
+	}
+}
+
+func newAPICart(cart *models.Cart) apiCart {
+	res := apiCart{
+		Items: make([]apiCartItem, 0, len(cart.Items)),
+		Total: cart.Total(),
+	}
+	for _, item := range cart.Items {
+		res.Items = append(res.Items, apiCartItem{
+			Product:  newAPIProduct(&item.Product),
+			Quantity: item.Quantity,
+			Subtotal: item.Subtotal(),
+		})
+	}
+	return res
+}
+
+func newAPIOrder(order *models.Order) apiOrder {
+	res := apiOrder{
+		ID:        order.ID,
+		Status:    order.Status,
+		Total:     order.Total,
+		CreatedAt: order.CreatedAt,
+		Items:     make([]apiOrderItem, 0, len(order.Items)),
+	}
+	for _, item := range order.Items {
+		res.Items = append(res.Items, apiOrderItem{
+			ProductID: item.ProductID,
+			Name:      item.Name,
+			SKU:       item.SKU,
+			Price:     item.Price,
+			Quantity:  item.Quantity,
+			Subtotal:  item.Subtotal(),
+		})
+	}
+	return res
+}
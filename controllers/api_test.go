@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"bytes"
+	stdcontext "context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ecommerce/models"
+	"ecommerce/payments"
+)
+
+func TestPaymentsWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		created time.Time
+		secret  string
+		want    int
+		status  string
+	}{
+		{"refunded at the gateway", time.Now(), "secret", http.StatusNoContent, models.OrderRefunded},
+		{"wrong secret", time.Now(), "other", http.StatusBadRequest, models.OrderPaid},
+		{"replayed", time.Now().Add(-time.Hour), "secret", http.StatusBadRequest, models.OrderPaid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, user, cart := newCheckout(t)
+			gw := payments.NewFake("secret")
+			order, err := checkout(stdcontext.Background(), s, gw, user, cart, payments.FakeSourceOK)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := NewAPI(nil, nil, nil, nil, s.Order, s, gw, nil, nil)
+
+			payload := []byte(fmt.Sprintf(`{"type":%q,"charge_id":%q,"created":%d}`,
+				payments.EventChargeRefunded, order.PaymentID, tt.created.Unix()))
+			r := httptest.NewRequest("POST", "/api/v1/payments/webhook", bytes.NewReader(payload))
+			r.Header.Set(payments.SignatureHeader, payments.NewVerifier(tt.secret).Sign(payload))
+			w := httptest.NewRecorder()
+			a.PaymentsWebhook(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			stored, err := s.Order.ByID(order.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != tt.status {
+				t.Fatalf("got order status %q, want %q", stored.Status, tt.status)
+			}
+		})
+	}
+}
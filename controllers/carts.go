@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"ecommerce/context"
+	"ecommerce/models"
+	"ecommerce/views"
+	"net/http"
+	"time"
+)
+
+const (
+	// cartCookie holds the token of the cart used by anonymous visitors
+	cartCookie = "cart_token"
+
+	cartCookieLifetime = 30 * 24 * time.Hour
+)
+
+func NewCarts(cs models.CartService) *Carts {
+	return &Carts{
+		ShowView: views.NewView("base", "carts/show"),
+		cs:       cs,
+	}
+}
+
+type Carts struct {
+	ShowView *views.View
+	cs       models.CartService
+}
+
+type CartItemForm struct {
+	ProductID uint `schema:"product_id"`
+	Quantity  int  `schema:"quantity"`
+}
+
+// Show displays the items in the current visitor's cart
+//
+// GET /cart
+func (c *Carts) Show(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	cart, err := c.cart(w, r, false)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = cart
+	c.ShowView.Render(w, r, vd)
+}
+
+// Add puts a product into the cart, creating the cart if the visitor does not have one yet
+//
+// POST /cart/add
+func (c *Carts) Add(w http.ResponseWriter, r *http.Request) {
+	var form CartItemForm
+	if err := parseForm(r, &form); err != nil {
+		c.renderError(w, r, err)
+		return
+	}
+	if form.Quantity == 0 {
+		form.Quantity = 1
+	}
+
+	cart, err := c.cart(w, r, true)
+	if err != nil {
+		c.renderError(w, r, err)
+		return
+	}
+
+	item := models.CartItem{
+		CartID:    cart.ID,
+		ProductID: form.ProductID,
+		Quantity:  form.Quantity,
+	}
+	if err := c.cs.AddItem(&item); err != nil {
+		c.renderError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusFound)
+}
+
+// Update changes the quantity of a product in the cart, a quantity of zero removes it
+//
+// POST /cart/update
+func (c *Carts) Update(w http.ResponseWriter, r *http.Request) {
+	var form CartItemForm
+	if err := parseForm(r, &form); err != nil {
+		c.renderError(w, r, err)
+		return
+	}
+
+	cart, err := c.cart(w, r, false)
+	if err != nil {
+		c.renderError(w, r, err)
+		return
+	}
+
+	item := models.CartItem{
+		CartID:    cart.ID,
+		ProductID: form.ProductID,
+		Quantity:  form.Quantity,
+	}
+	if err := c.cs.UpdateItem(&item); err != nil {
+		c.renderError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusFound)
+}
+
+// Remove takes a product out of the cart
+//
+// POST /cart/remove
+func (c *Carts) Remove(w http.ResponseWriter, r *http.Request) {
+	var form CartItemForm
+	if err := parseForm(r, &form); err != nil {
+		c.renderError(w, r, err)
+		return
+	}
+
+	cart, err := c.cart(w, r, false)
+	if err != nil {
+		c.renderError(w, r, err)
+		return
+	}
+
+	item := models.CartItem{
+		CartID:    cart.ID,
+		ProductID: form.ProductID,
+	}
+	if err := c.cs.RemoveItem(&item); err != nil {
+		c.renderError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusFound)
+}
+
+// renderError displays the cart again with the error as an alert
+func (c *Carts) renderError(w http.ResponseWriter, r *http.Request, err error) {
+	var vd views.Data
+	vd.SetAlert(err)
+	if cart, err := c.cart(w, r, false); err == nil {
+		vd.Yield = cart
+	}
+	c.ShowView.Render(w, r, vd)
+}
+
+// cart finds the cart of the current visitor. Signed in users are taken from the
+// request context, anonymous visitors are identified by the cart_token cookie.
+// When create is true a new cart is created if none is found,
+// otherwise an empty cart is returned
+func (c *Carts) cart(w http.ResponseWriter, r *http.Request, create bool) (*models.Cart, error) {
+	var cart *models.Cart
+	var err error
+
+	user := context.User(r.Context())
+	if user != nil {
+		cart, err = c.cs.ByUserID(user.ID)
+	} else if cookie, cookieErr := r.Cookie(cartCookie); cookieErr == nil {
+		cart, err = c.cs.ByToken(cookie.Value)
+	} else {
+		err = models.ErrNotFound
+	}
+
+	switch {
+	case err == nil:
+		return cart, nil
+	case err != models.ErrNotFound:
+		return nil, err
+	case !create:
+		return &models.Cart{}, nil
+	}
+
+	cart = &models.Cart{}
+	if user != nil {
+		cart.UserID = user.ID
+	}
+	if err := c.cs.Create(cart); err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		cookie := http.Cookie{
+			Name:     cartCookie,
+			Value:    cart.Token,
+			Path:     "/",
+			Expires:  time.Now().Add(cartCookieLifetime),
+			HttpOnly: true,
+		}
+		http.SetCookie(w, &cookie)
+	}
+
+	return cart, nil
+}
@@ -1,19 +1,113 @@
 package controllers
 
 import (
+	"ecommerce/models"
+	"ecommerce/throttle"
 	"github.com/gorilla/schema"
+	"net"
 	"net/http"
+	"net/url"
 )
 
 func parseForm(r *http.Request, dst interface{}) error {
 	if err := r.ParseForm(); err != nil {
 		return err
 	}
+	return parseValues(r.PostForm, dst)
+}
+
+// parseURLParams works like parseForm but decodes the query string
+func parseURLParams(r *http.Request, dst interface{}) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	return parseValues(r.Form, dst)
+}
 
+func parseValues(values url.Values, dst interface{}) error {
 	decoder := schema.NewDecoder()
-	if err := decoder.Decode(dst, r.PostForm); err != nil {
+	// forms also carry fields like the CSRF token that are not part of dst
+	decoder.IgnoreUnknownKeys(true)
+	if err := decoder.Decode(dst, values); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// newSession starts a session for the user on the device making the request,
+// the returned session holds the token to hand back to that device
+func newSession(ss models.SessionService, r *http.Request, user *models.User) (*models.Session, error) {
+	session := models.Session{
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	}
+	if err := ss.Create(&session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// clientIP returns the IP address the request came from, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// errTooManyAttempts is returned by authenticate while the client IP is throttled
+var errTooManyAttempts = publicError("Too many failed login attempts, please wait a moment and try again")
+
+// authenticate wraps UserService.Authenticate with per-IP throttling: every failed attempt
+// from the client IP makes the next one wait longer, whichever account it targets, until
+// a login succeeds. Like Authenticate it returns the user along with models.ErrTOTPRequired
+func authenticate(us models.UserService, limiter *throttle.Limiter, r *http.Request, email, password string) (*models.User, error) {
+	ip := clientIP(r)
+	if limiter.Wait(ip) > 0 {
+		return nil, errTooManyAttempts
+	}
+
+	user, err := us.AuthenticateContext(r.Context(), email, password)
+	switch err {
+	case nil:
+		limiter.Reset(ip)
+		return user, nil
+	case models.ErrTOTPRequired:
+		return user, err
+	case models.ErrCredentialsInvalid:
+		limiter.Fail(ip)
+	}
+	return nil, err
+}
+
+// throttleTOTP runs fn, which checks a two-factor code, with the same per-IP throttling
+// as authenticate. Codes are short enough to guess without it
+func throttleTOTP(limiter *throttle.Limiter, r *http.Request, fn func() error) error {
+	ip := clientIP(r)
+	if limiter.Wait(ip) > 0 {
+		return errTooManyAttempts
+	}
+
+	err := fn()
+	switch err {
+	case nil:
+		limiter.Reset(ip)
+	case models.ErrTOTPInvalid, models.ErrAccountLocked:
+		limiter.Fail(ip)
+	}
+	return err
+}
+
+// publicError is an error whose message is safe to show to users, like modelError
+type publicError string
+
+func (e publicError) Error() string {
+	return string(e)
+}
+
+func (e publicError) Public() string {
+	return string(e)
+}
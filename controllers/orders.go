@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	stdcontext "context"
+	"ecommerce/context"
+	"ecommerce/models"
+	"ecommerce/payments"
+	"ecommerce/views"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// NewOrders creates the orders controller, checkouts run in a transaction of txr
+func NewOrders(os models.OrderService, cs models.CartService, txr Transactor, gw payments.Gateway) *Orders {
+	return &Orders{
+		IndexView: views.NewView("base", "orders/index"),
+		ShowView:  views.NewView("base", "orders/show"),
+		CartView:  views.NewView("base", "carts/show"),
+		os:        os,
+		cs:        cs,
+		txr:       txr,
+		gw:        gw,
+	}
+}
+
+type Orders struct {
+	IndexView *views.View
+	ShowView  *views.View
+	CartView  *views.View
+	os        models.OrderService
+	cs        models.CartService
+	txr       Transactor
+	gw        payments.Gateway
+}
+
+// Transactor runs fn with services sharing one database transaction,
+// it is implemented by models.Services
+type Transactor interface {
+	Transaction(fn func(tx *models.Services) error) error
+	TransactionContext(ctx stdcontext.Context, fn func(tx *models.Services) error) error
+}
+
+type CheckoutForm struct {
+	PaymentSource string `schema:"payment_source"`
+}
+
+// Index lists the orders placed by the signed in user
+//
+// GET /orders
+func (o *Orders) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var vd views.Data
+	orders, err := o.os.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = orders
+	o.IndexView.Render(w, r, vd)
+}
+
+// Show displays a single order, users can only see their own orders
+//
+// GET /orders/:id
+func (o *Orders) Show(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	order, err := o.orderByID(w, r, user)
+	if err != nil {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = order
+	o.ShowView.Render(w, r, vd)
+}
+
+// Create places an order with the items in the signed in user's cart and charges
+// the payment source for it. The cart is kept if the payment is declined
+//
+// POST /orders
+func (o *Orders) Create(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var vd views.Data
+	var form CheckoutForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		o.CartView.Render(w, r, vd)
+		return
+	}
+
+	cart, err := o.cs.ByUserID(user.ID)
+	if err != nil {
+		if err == models.ErrNotFound {
+			err = models.ErrOrderEmpty
+		}
+		vd.SetAlert(err)
+		o.CartView.Render(w, r, vd)
+		return
+	}
+
+	order, err := checkout(r.Context(), o.txr, o.gw, user, cart, form.PaymentSource)
+	if err != nil {
+		vd.SetAlert(err)
+		vd.Yield = cart
+		o.CartView.Render(w, r, vd)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/orders/%d", order.ID), http.StatusFound)
+}
+
+// checkout works in three steps, so no transaction stays open while the
+// payment gateway answers:
+//  1. a transaction claims the cart, places the order and reserves its stock
+//  2. the order total is authorized and captured outside of any transaction
+//  3. a second transaction marks the order paid and empties the cart
+//
+// Claiming the cart first makes sure a double submitted checkout is charged
+// only once. When a later step fails the payment is voided, or refunded once
+// it was captured, the order is cancelled to release its stock and the cart is
+// restored, even once ctx is done. Only users with a verified email address
+// can check out
+func checkout(ctx stdcontext.Context, txr Transactor, gw payments.Gateway,
+	user *models.User, cart *models.Cart, source string) (*models.Order, error) {
+	if !user.Verified() {
+		return nil, models.ErrEmailNotVerified
+	}
+	if len(cart.Items) == 0 {
+		return nil, models.ErrOrderEmpty
+	}
+
+	var order *models.Order
+	err := txr.TransactionContext(ctx, func(tx *models.Services) error {
+		if err := tx.Cart.Claim(cart.ID); err != nil {
+			return err
+		}
+		var err error
+		order, err = tx.Order.Place(cart)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	charge, err := gw.Authorize(order.Total, source)
+	if err != nil {
+		cancelCheckout(txr, order.ID, cart.ID)
+		return nil, err
+	}
+
+	if _, err := gw.Capture(charge.ID, order.Total); err != nil {
+		gw.Void(charge.ID)
+		cancelCheckout(txr, order.ID, cart.ID)
+		return nil, err
+	}
+
+	paid := false
+	defer func() {
+		if !paid {
+			gw.Refund(charge.ID, order.Total)
+			cancelCheckout(txr, order.ID, cart.ID)
+		}
+	}()
+
+	order.PaymentID = charge.ID
+	err = txr.TransactionContext(ctx, func(tx *models.Services) error {
+		if err := tx.Order.Transition(order, models.OrderPaid); err != nil {
+			return err
+		}
+		return tx.Cart.Delete(cart.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	paid = true
+	return order, nil
+}
+
+// cancelCheckout cancels an order whose payment did not go through, releasing
+// its stock, and gives the claimed cart back to the user. The order is read
+// again since a rolled back transaction may have left the copy of the caller
+// out of date
+func cancelCheckout(txr Transactor, orderID, cartID uint) {
+	err := txr.Transaction(func(tx *models.Services) error {
+		order, err := tx.Order.ByID(orderID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Order.Transition(order, models.OrderCancelled); err != nil {
+			return err
+		}
+		return tx.Cart.Restore(cartID)
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// orderByID parses the id route variable and looks up the order.
+// Orders belonging to other users are reported as not found.
+// If an error is returned, the response has already been written
+func (o *Orders) orderByID(w http.ResponseWriter, r *http.Request, user *models.User) (*models.Order, error) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	order, err := o.os.ByID(uint(id))
+	if err == nil && order.UserID != user.ID {
+		err = models.ErrNotFound
+	}
+
+	switch err {
+	case nil:
+		return order, nil
+	case models.ErrNotFound:
+		http.Error(w, "Order not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+	}
+	return nil, err
+}
@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	stdcontext "context"
+	"sync"
+	"testing"
+	"time"
+
+	"ecommerce/models"
+	"ecommerce/payments"
+)
+
+// recordingGateway is the fake gateway keeping track of the amounts it was asked
+// for, Capture fails with captureErr when set
+type recordingGateway struct {
+	*payments.Fake
+
+	mu         sync.Mutex
+	authorized []int
+	captured   []int
+	voided     int
+	captureErr error
+}
+
+func (g *recordingGateway) Authorize(amount int, source string) (*payments.Charge, error) {
+	g.mu.Lock()
+	g.authorized = append(g.authorized, amount)
+	g.mu.Unlock()
+	return g.Fake.Authorize(amount, source)
+}
+
+func (g *recordingGateway) Capture(chargeID string, amount int) (*payments.Charge, error) {
+	if g.captureErr != nil {
+		return nil, g.captureErr
+	}
+	g.mu.Lock()
+	g.captured = append(g.captured, amount)
+	g.mu.Unlock()
+	return g.Fake.Capture(chargeID, amount)
+}
+
+func (g *recordingGateway) Void(chargeID string) (*payments.Charge, error) {
+	g.mu.Lock()
+	g.voided++
+	g.mu.Unlock()
+	return g.Fake.Void(chargeID)
+}
+
+// newCheckout builds memory services with a verified user whose cart holds two
+// shirts, five of which are in stock
+func newCheckout(t *testing.T) (*models.Services, *models.User, *models.Cart) {
+	t.Helper()
+
+	s, err := models.NewServices(
+		models.WithMemory(),
+		models.WithProduct(),
+		models.WithCart(),
+		models.WithOrder(),
+		models.WithInventory(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	user := &models.User{EmailVerifiedAt: &now}
+	user.ID = 1
+
+	product := models.Product{Name: "Blue T-Shirt", SKU: "TS-1", Price: 1500}
+	if err := s.Product.Create(&product); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Inventory.Set(&models.Stock{SKU: "TS-1", OnHand: 5}); err != nil {
+		t.Fatal(err)
+	}
+	cart := models.Cart{UserID: user.ID}
+	if err := s.Cart.Create(&cart); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Cart.AddItem(&models.CartItem{CartID: cart.ID, ProductID: product.ID, Quantity: 2}); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := s.Cart.ByUserID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, user, loaded
+}
+
+func TestCheckoutChargesOnce(t *testing.T) {
+	s, user, cart := newCheckout(t)
+	gw := &recordingGateway{Fake: payments.NewFake("secret")}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = checkout(stdcontext.Background(), s, gw, user, cart, payments.FakeSourceOK)
+		}(i)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err == models.ErrCartCheckedOut {
+			failed++
+		} else if err != nil {
+			t.Fatalf("got error %v, want nil or ErrCartCheckedOut", err)
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("got %d checkouts refused, want 1", failed)
+	}
+	if len(gw.authorized) != 1 || len(gw.captured) != 1 {
+		t.Fatalf("got %d authorizations and %d captures, want 1 each", len(gw.authorized), len(gw.captured))
+	}
+	if gw.authorized[0] != 3000 || gw.captured[0] != 3000 {
+		t.Fatalf("authorized %d and captured %d, want the order total 3000 both times", gw.authorized[0], gw.captured[0])
+	}
+	if _, err := s.Cart.ByUserID(user.ID); err != models.ErrNotFound {
+		t.Fatalf("got error %v looking up the cart, want ErrNotFound", err)
+	}
+}
+
+func TestCheckoutFailureRestoresCart(t *testing.T) {
+	tests := []struct {
+		name       string
+		source     string
+		captureErr error
+		want       error
+		voided     int
+	}{
+		{"declined", payments.FakeSourceDeclined, nil, payments.ErrCardDeclined, 0},
+		{"capture failed", payments.FakeSourceOK, payments.ErrChargeState, payments.ErrChargeState, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, user, cart := newCheckout(t)
+			gw := &recordingGateway{Fake: payments.NewFake("secret"), captureErr: tt.captureErr}
+
+			_, err := checkout(stdcontext.Background(), s, gw, user, cart, tt.source)
+			if err != tt.want {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if gw.voided != tt.voided {
+				t.Fatalf("got %d voided charges, want %d", gw.voided, tt.voided)
+			}
+
+			orders, err := s.Order.ByUserID(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(orders) != 1 || orders[0].Status != models.OrderCancelled {
+				t.Fatalf("got orders %+v, want one cancelled order", orders)
+			}
+			stock, err := s.Inventory.BySKU("TS-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stock.OnHand != 5 || stock.Reserved != 0 {
+				t.Fatalf("got %d on hand and %d reserved, want 5 and 0", stock.OnHand, stock.Reserved)
+			}
+			restored, err := s.Cart.ByUserID(user.ID)
+			if err != nil {
+				t.Fatalf("looking up the restored cart: %v", err)
+			}
+			if len(restored.Items) != 1 || restored.Items[0].Quantity != 2 {
+				t.Fatalf("got cart items %+v, want the two shirts back", restored.Items)
+			}
+		})
+	}
+}
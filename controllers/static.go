@@ -1,12 +1,16 @@
 package controllers
 
-import "ecommerce/views"
+import (
+	"ecommerce/views"
+	"net/http"
+)
 
 func NewStatic() *Static {
 	return &Static{
 		HomeView: views.NewView("base", "static/home"),
 		ContactView: views.NewView("base", "static/contact"),
 		Error404View: views.NewView("base", "static/error404"),
+		CSRFErrorView: views.NewView("base", "static/csrf_error"),
 	}
 }
 
@@ -15,4 +19,13 @@ type Static struct {
 	HomeView 		*views.View
 	ContactView 	*views.View
 	Error404View	*views.View
+	CSRFErrorView	*views.View
+}
+
+// CSRFError is shown when a form is posted without a valid CSRF token,
+// usually because the page was open for too long or cookies are disabled
+func (s *Static) CSRFError(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusForbidden)
+	s.CSRFErrorView.Render(w, r, nil)
 }
\ No newline at end of file
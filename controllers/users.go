@@ -1,25 +1,83 @@
 package controllers
 
 import (
+	"ecommerce/context"
 	"ecommerce/models"
-	"ecommerce/rand"
+	"ecommerce/throttle"
+	"ecommerce/totp"
 	"ecommerce/views"
 	"fmt"
+	"log"
 	"net/http"
+	"time"
 )
 
-func NewUsers(us models.UserService) *Users {
+// loginTokenCookie carries the user from the password to the two-factor step of a login
+const loginTokenCookie = "login_token"
+
+// NewUsers creates the users controller, totpIssuer names the site in authenticator apps
+func NewUsers(us models.UserService, ss models.SessionService, cs models.CartService, mailer Mailer,
+	limiter *throttle.Limiter, totpIssuer string) *Users {
 	return &Users{
 		NewView: views.NewView("base", "users/new"),
 		LoginView: views.NewView("base", "users/login"),
+		LoginTOTPView: views.NewView("base", "users/login_totp"),
+		TwoFactorView: views.NewView("base", "users/two_factor"),
+		SessionsView: views.NewView("base", "users/sessions"),
+		ForgotPwView: views.NewView("base", "users/forgot_pw"),
+		ResetPwView: views.NewView("base", "users/reset_pw"),
+		VerifyView: views.NewView("base", "users/verify"),
 		us:		 us,
+		ss:		 ss,
+		cs:		 cs,
+		mailer:	 mailer,
+		limiter: limiter,
+		totpIssuer: totpIssuer,
 	}
 }
 
 type Users struct {
 	NewView 	*views.View
 	LoginView	*views.View
+	LoginTOTPView	*views.View
+	TwoFactorView	*views.View
+	SessionsView	*views.View
+	ForgotPwView	*views.View
+	ResetPwView	*views.View
+	VerifyView	*views.View
 	us			models.UserService
+	ss			models.SessionService
+	cs			models.CartService
+	mailer		Mailer
+	limiter		*throttle.Limiter
+	totpIssuer	string
+}
+
+// Mailer sends the emails the users controller needs
+type Mailer interface {
+	// ResetPw emails the password reset token to the user
+	ResetPw(toEmail, token string) error
+
+	// Verify emails the email verification token to the user
+	Verify(toEmail, token string) error
+}
+
+// SessionsData is what the sessions view expects in Yield
+type SessionsData struct {
+	Sessions  []models.Session
+	CurrentID uint
+}
+
+// TwoFactorData is what the two-factor view expects in Yield. Secret and URI are set
+// while two-factor is off, RecoveryCodes only right after new ones were generated.
+// Required is set when the role of the user does not allow turning it off
+type TwoFactorData struct {
+	Enabled           bool
+	Required          bool
+	Secret            string
+	URI               string
+	RecoveryCodesLeft int
+	RecoveryCodes     []string
 }
 
 type SignupForm struct {
@@ -33,8 +91,25 @@ type LoginForm struct {
 	Password	string `schema:"password"`
 }
 
+// TOTPForm holds a code from an authenticator app or a recovery code
+type TOTPForm struct {
+	Code		string `schema:"code"`
+}
+
+// VerifyForm is read from the query string of the emailed verification link
+type VerifyForm struct {
+	Token		string `schema:"token"`
+}
+
+// ResetPwForm is used by both the forgot and reset password forms
+type ResetPwForm struct {
+	Email		string `schema:"email"`
+	Token		string `schema:"token"`
+	Password	string `schema:"password"`
+}
+
 func (u *Users) New(w http.ResponseWriter, r *http.Request) {
-	u.NewView.Render(w, nil)
+	u.NewView.Render(w, r, nil)
 }
 
 // Create is used to process the signup form when user creates a new account
@@ -45,7 +120,7 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	var form SignupForm
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
-		u.NewView.Render(w, vd)
+		u.NewView.Render(w, r, vd)
 		return
 	}
 
@@ -55,13 +130,18 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		Password: form.Password,
 	}
 
-	if err := u.us.Create(&user); err != nil {
+	if err := u.us.CreateContext(r.Context(), &user); err != nil {
 		vd.SetAlert(err)
-		u.NewView.Render(w, vd)
+		u.NewView.Render(w, r, vd)
 		return
 	}
 
-	err := u.signIn(w, &user)
+	// the account works without it, the link can be sent again from the verify page
+	if err := sendVerification(u.us, u.mailer, &user); err != nil {
+		log.Println(err)
+	}
+
+	err := u.signIn(w, r, &user)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
@@ -78,71 +158,536 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	form := LoginForm{}
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
-		u.LoginView.Render(w, vd)
+		u.LoginView.Render(w, r, vd)
 		return
 	}
 
-	user, err := u.us.Authenticate(form.Email, form.Password)
-
-	if err != nil {
-		switch err {
-		case models.ErrNotFound:
-			vd.AlertError("No user exists with that email address")
-		default:
+	user, err := authenticate(u.us, u.limiter, r, form.Email, form.Password)
+	if err == models.ErrTOTPRequired {
+		if err := u.setLoginToken(w, user); err != nil {
 			vd.SetAlert(err)
+			u.LoginView.Render(w, r, vd)
+			return
 		}
-		u.LoginView.Render(w, vd)
+		http.Redirect(w, r, "/login/totp", http.StatusFound)
+		return
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
 		return
 	}
 
-	err = u.signIn(w, user)
+	err = u.signIn(w, r, user)
 	if err != nil {
 		vd.SetAlert(err)
-		u.LoginView.Render(w, vd)
+		u.LoginView.Render(w, r, vd)
 		return
 	}
 
 	http.Redirect(w, r, "/cookietest", http.StatusFound)
 }
 
-// CookieTest is used to display cookies set on the current user
-func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("remember_token")
+// LoginTOTPForm displays the second step of the login for users with two-factor authentication
+//
+// GET /login/totp
+func (u *Users) LoginTOTPForm(w http.ResponseWriter, r *http.Request) {
+	if _, err := r.Cookie(loginTokenCookie); err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	u.LoginTOTPView.Render(w, r, nil)
+}
+
+// LoginTOTP checks the two-factor code of a user whose password was accepted and signs them in
+//
+// POST /login/totp
+func (u *Users) LoginTOTP(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(loginTokenCookie)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	var vd views.Data
+	var form TOTPForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.LoginTOTPView.Render(w, r, vd)
 		return
 	}
 
-	user, err := u.us.ByRemember(cookie.Value)
+	// an expired token or a password changed in between means starting over
+	user, err := u.us.ByLoginToken(cookie.Value)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		clearLoginTokenCookie(w)
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
 		return
 	}
 
-	fmt.Fprintln(w, user)
+	err = throttleTOTP(u.limiter, r, func() error {
+		return u.us.VerifyTOTPContext(r.Context(), user, form.Code)
+	})
+	if err == models.ErrAccountLocked {
+		clearLoginTokenCookie(w)
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		u.LoginTOTPView.Render(w, r, vd)
+		return
+	}
+
+	clearLoginTokenCookie(w)
+	if err := u.signIn(w, r, user); err != nil {
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+	http.Redirect(w, r, "/cookietest", http.StatusFound)
 }
 
-// signIn is used to sign the given user in via cookies
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if user.Remember == "" {
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
+// Logout is used to sign the current device out. Its session is deleted so the
+// old cookie stops working server side, other devices stay signed in
+//
+// POST /logout
+func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
+	clearRememberCookie(w)
+
+	if session := context.Session(r.Context()); session != nil {
+		if err := u.ss.Delete(session.ID); err != nil {
+			log.Println(err)
 		}
+	}
 
-		user.Remember = token
-		err = u.us.Update(user)
-		if err != nil {
-			return err
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// Sessions lists the devices the user is signed in on
+//
+// GET /sessions
+func (u *Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var vd views.Data
+	sessions, err := u.ss.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	data := SessionsData{
+		Sessions: sessions,
+	}
+	if session := context.Session(r.Context()); session != nil {
+		data.CurrentID = session.ID
+	}
+	vd.Yield = data
+	u.SessionsView.Render(w, r, vd)
+}
+
+// Revoke signs one of the user's devices out. Revoking the current
+// session is the same as logging out
+//
+// POST /sessions/:id/revoke
+func (u *Users) Revoke(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	id, err := idFromVars(r, "id")
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	sessions, err := u.ss.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, views.AlertMsgGeneric, http.StatusInternalServerError)
+		return
+	}
+
+	// only sessions of the signed in user can be revoked
+	owned := false
+	for _, session := range sessions {
+		if session.ID == id {
+			owned = true
+			break
 		}
 	}
+	if !owned {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := u.ss.Delete(id); err != nil {
+		log.Println(err)
+		http.Error(w, views.AlertMsgGeneric, http.StatusInternalServerError)
+		return
+	}
+
+	if current := context.Session(r.Context()); current != nil && current.ID == id {
+		clearRememberCookie(w)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/sessions", http.StatusFound)
+}
+
+// TwoFactor shows the two-factor settings of the user. While two-factor is off
+// it shows the secret to add to an authenticator app
+//
+// GET /account/2fa
+func (u *Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	u.renderTwoFactor(w, r, views.Data{}, nil)
+}
+
+// EnableTOTP turns two-factor authentication on once the code shows the app was set up,
+// the recovery codes are shown once
+//
+// POST /account/2fa/enable
+func (u *Users) EnableTOTP(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var vd views.Data
+	var form TOTPForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderTwoFactor(w, r, vd, nil)
+		return
+	}
+
+	var codes []string
+	err := throttleTOTP(u.limiter, r, func() (err error) {
+		codes, err = u.us.EnableTOTP(user, form.Code)
+		return err
+	})
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderTwoFactor(w, r, vd, nil)
+		return
+	}
+
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two-factor authentication is on.",
+	}
+	u.renderTwoFactor(w, r, vd, codes)
+}
+
+// DisableTOTP turns two-factor authentication off
+//
+// POST /account/2fa/disable
+func (u *Users) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var vd views.Data
+	var form TOTPForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderTwoFactor(w, r, vd, nil)
+		return
+	}
+
+	err := throttleTOTP(u.limiter, r, func() error {
+		return u.us.DisableTOTP(user, form.Code)
+	})
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderTwoFactor(w, r, vd, nil)
+		return
+	}
+
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two-factor authentication is off.",
+	}
+	u.renderTwoFactor(w, r, vd, nil)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user, used or not
+//
+// POST /account/2fa/recovery-codes
+func (u *Users) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var vd views.Data
+	var form TOTPForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderTwoFactor(w, r, vd, nil)
+		return
+	}
+
+	var codes []string
+	err := throttleTOTP(u.limiter, r, func() (err error) {
+		codes, err = u.us.RegenerateRecoveryCodes(user, form.Code)
+		return err
+	})
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderTwoFactor(w, r, vd, nil)
+		return
+	}
+	u.renderTwoFactor(w, r, vd, codes)
+}
+
+// InitiateReset emails a password reset link to the user. The same message is shown
+// whether or not the email belongs to an account, so it can not be used to find users.
+// The email is sent in the background and its errors are only logged, otherwise the
+// response time and mail errors would tell the accounts apart
+//
+// POST /forgot
+func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.ForgotPwView.Render(w, r, vd)
+		return
+	}
+
+	token, err := u.us.InitiateReset(form.Email)
+	switch err {
+	case nil:
+		go func(email string) {
+			if err := u.mailer.ResetPw(email, token); err != nil {
+				log.Println(err)
+			}
+		}(form.Email)
+	case models.ErrNotFound:
+	default:
+		vd.SetAlert(err)
+		u.ForgotPwView.Render(w, r, vd)
+		return
+	}
+
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "If an account exists for that email, instructions for resetting its password have been sent to it.",
+	}
+	u.ForgotPwView.Render(w, r, vd)
+}
+
+// ResetPw displays the reset password form, filled with the token from the emailed link
+//
+// GET /reset
+func (u *Users) ResetPw(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+	u.ResetPwView.Render(w, r, vd)
+}
+
+// CompleteReset sets the new password and signs the user in on this device,
+// every other session of the user was ended by the reset
+//
+// POST /reset
+func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+
+	user, err := u.us.CompleteReset(form.Token, form.Password)
+	if err != nil {
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+
+	if err := u.signIn(w, r, user); err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/cookietest", http.StatusFound)
+}
+
+// Verify marks the email address as verified using the token of the emailed link
+//
+// GET /verify
+func (u *Users) Verify(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form VerifyForm
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.VerifyView.Render(w, r, vd)
+		return
+	}
+
+	user, err := u.us.VerifyEmail(form.Token)
+	if err != nil {
+		vd.SetAlert(err)
+		u.VerifyView.Render(w, r, vd)
+		return
+	}
+
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Thanks, " + user.Email + " is now verified.",
+	}
+	vd.Yield = user
+	u.VerifyView.Render(w, r, vd)
+}
+
+// ResendVerification emails a new verification link to the signed in user
+//
+// POST /verify/resend
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var vd views.Data
+	vd.Yield = user
+	if user.Verified() {
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlInfo,
+			Message: "Your email address is already verified.",
+		}
+		u.VerifyView.Render(w, r, vd)
+		return
+	}
+
+	if err := sendVerification(u.us, u.mailer, user); err != nil {
+		vd.SetAlert(err)
+		u.VerifyView.Render(w, r, vd)
+		return
+	}
+
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "A new verification link has been sent to " + user.Email + ".",
+	}
+	u.VerifyView.Render(w, r, vd)
+}
+
+// CookieTest is used to display the user signed in through the remember_token cookie
+func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user == nil {
+		http.Error(w, "No user signed in", http.StatusUnauthorized)
+		return
+	}
+
+	fmt.Fprintln(w, user)
+}
+
+// signIn is used to sign the given user in via cookies, starting a new session for this device.
+// Any cart built up while anonymous is merged into the user's cart
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	session, err := newSession(u.ss, r, user)
+	if err != nil {
+		return err
+	}
 
 	cookie := http.Cookie{
 		Name: 		"remember_token",
-		Value: 		user.Remember,
+		Value: 		session.Token,
+		Path:		"/",
+		Expires:	session.ExpiresAt,
 		HttpOnly: 	true,
 	}
 
 	http.SetCookie(w, &cookie)
+
+	if anonCart, err := r.Cookie(cartCookie); err == nil {
+		if err := u.cs.Merge(anonCart.Value, user.ID); err != nil {
+			return err
+		}
+		expired := http.Cookie{
+			Name:   cartCookie,
+			Path:   "/",
+			MaxAge: -1,
+		}
+		http.SetCookie(w, &expired)
+	}
 	return nil
 }
+
+// renderTwoFactor renders the two-factor view for the signed in user,
+// enrolling them first if two-factor is off
+func (u *Users) renderTwoFactor(w http.ResponseWriter, r *http.Request, vd views.Data, recoveryCodes []string) {
+	user := context.User(r.Context())
+
+	data := TwoFactorData{
+		Enabled:       user.TOTPEnabled,
+		Required:      user.RequiresTOTP(),
+		RecoveryCodes: recoveryCodes,
+	}
+	var err error
+	if user.TOTPEnabled {
+		data.RecoveryCodesLeft, err = u.us.RecoveryCodesLeft(user)
+	} else {
+		data.Secret, err = u.us.EnrollTOTP(user)
+		if err == nil {
+			data.URI = totp.ProvisioningURI(data.Secret, u.totpIssuer, user.Email)
+		}
+	}
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	vd.Yield = data
+	u.TwoFactorView.Render(w, r, vd)
+}
+
+// setLoginToken stores the token of a login waiting for its second factor in a cookie,
+// it is only sent to the two-factor step and expires with the token
+func (u *Users) setLoginToken(w http.ResponseWriter, user *models.User) error {
+	token, err := u.us.LoginToken(user)
+	if err != nil {
+		return err
+	}
+
+	cookie := http.Cookie{
+		Name:     loginTokenCookie,
+		Value:    token,
+		Path:     "/login/totp",
+		MaxAge:   int(5 * time.Minute / time.Second),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+	return nil
+}
+
+// clearLoginTokenCookie expires the login_token cookie in the browser
+func clearLoginTokenCookie(w http.ResponseWriter) {
+	cookie := http.Cookie{
+		Name:     loginTokenCookie,
+		Value:    "",
+		Path:     "/login/totp",
+		MaxAge:   -1,
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+}
+
+// sendVerification emails the user a link to verify their email address
+func sendVerification(us models.UserService, mailer Mailer, user *models.User) error {
+	token, err := us.VerificationToken(user)
+	if err != nil {
+		return err
+	}
+	return mailer.Verify(user.Email, token)
+}
+
+// clearRememberCookie expires the remember_token cookie in the browser
+func clearRememberCookie(w http.ResponseWriter) {
+	cookie := http.Cookie{
+		Name:     "remember_token",
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+}
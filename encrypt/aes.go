@@ -0,0 +1,57 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"ecommerce/rand"
+)
+
+// ErrCiphertextInvalid is returned by Decrypt for data that was not made by Encrypt with the same key
+var ErrCiphertextInvalid = errors.New("encrypt: invalid ciphertext")
+
+// AESGCM encrypts small secrets, like TOTP secrets, before they are stored.
+// It is safe for concurrent use
+type AESGCM struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCM creates an AESGCM with key, which must be 16, 24 or 32 bytes long
+func NewAESGCM(key string) (*AESGCM, error) {
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCM{aead: aead}, nil
+}
+
+// Encrypt returns plaintext encrypted with a random nonce, base64 URL encoded
+func (a *AESGCM) Encrypt(plaintext string) (string, error) {
+	nonce, err := rand.Bytes(a.aead.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	sealed := a.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.URLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverses Encrypt, failing if the ciphertext was tampered with
+func (a *AESGCM) Decrypt(ciphertext string) (string, error) {
+	sealed, err := base64.URLEncoding.DecodeString(ciphertext)
+	if err != nil || len(sealed) < a.aead.NonceSize() {
+		return "", ErrCiphertextInvalid
+	}
+	nonce, sealed := sealed[:a.aead.NonceSize()], sealed[a.aead.NonceSize():]
+	plaintext, err := a.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", ErrCiphertextInvalid
+	}
+	return string(plaintext), nil
+}
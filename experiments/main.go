@@ -3,29 +3,45 @@ package main
 import (
 	"fmt"
 
+	"ecommerce/config"
+	"ecommerce/encrypt"
+	"ecommerce/hash"
+	"ecommerce/migrations"
 	"ecommerce/models"
 
 	_ "github.com/lib/pq"
 )
 
-const (
-	host     = "localhost"
-	port     = 5432
-	user     = "postgres"
-	password = "postgres"
-	dbname   = "ecommerce_dev"
-)
-
 func main() {
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
-		"password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
-	us, err := models.NewUserService(psqlInfo)
+	cfg, err := config.Load(".config.json")
+	if err != nil {
+		panic(err)
+	}
+	keyring, err := hash.NewKeyring(hash.Key{ID: cfg.HMACKeyID, Secret: cfg.HMACKey})
+	if err != nil {
+		panic(err)
+	}
+	totpCipher, err := encrypt.NewAESGCM(cfg.TOTPKey)
 	if err != nil {
 		panic(err)
 	}
-	defer us.Close()
-	us.DestructiveReset()
+	services, err := models.NewServices(
+		models.WithGorm(cfg.Database.Dialect, cfg.Database.ConnectionInfo()),
+		models.WithLogMode(true),
+		models.WithUser(models.Peppers{{Version: cfg.PepperVersion, Secret: cfg.Pepper}}, keyring, models.DefaultPasswordPolicy(), totpCipher),
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer services.Close()
+	migrator, err := migrations.New(services.DB(), cfg.Database.Dialect)
+	if err != nil {
+		panic(err)
+	}
+	if err := migrator.Reset(); err != nil {
+		panic(err)
+	}
+	us := services.User
 
 	// Create a user
 	user := models.User{
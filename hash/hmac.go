@@ -4,26 +4,31 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
-	"hash"
 )
 
 // HMAC is a wrapper around crypt/hmac making a bit easier to use
 type HMAC struct {
-	hmac hash.Hash
+	key []byte
 }
 
 // NewHMAC created and returns a new HMAC object
 func NewHMAC(key string) HMAC {
-	h := hmac.New(sha256.New, []byte(key))
 	return HMAC{
-		hmac: h,
+		key: []byte(key),
 	}
 }
 
-// Hash will hash the provided input string using HMAC with the secret key
+// Hash will hash the provided input string using HMAC with the secret key.
+// A new hash.Hash is created on every call so HMAC is safe for concurrent use
 func (h HMAC) Hash(input string) string {
-	h.hmac.Reset()
-	h.hmac.Write([]byte(input))
-	b := h.hmac.Sum(nil)
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(input))
+	b := mac.Sum(nil)
 	return base64.URLEncoding.EncodeToString(b)
-}
\ No newline at end of file
+}
+
+// Equal reports whether digest is the hash of input, comparing in constant time
+// so it can be used to check signatures without leaking timing information
+func (h HMAC) Equal(input, digest string) bool {
+	return hmac.Equal([]byte(h.Hash(input)), []byte(digest))
+}
@@ -0,0 +1,110 @@
+package hash
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"strings"
+)
+
+// KeySeparator separates the key ID from the digest in hashes made by a Keyring
+const KeySeparator = "$"
+
+// Key is one HMAC key of a Keyring
+type Key struct {
+	ID     string
+	Secret string
+}
+
+// Keyring holds the current HMAC key and the previous ones, so keys can be rotated
+// without breaking the digests already stored. Digests are "<key id>$<digest>" so the
+// key that made them is known, digests made before the keyring have no ID at all
+type Keyring struct {
+	keys []keyringEntry
+}
+
+type keyringEntry struct {
+	id   string
+	hmac HMAC
+}
+
+// NewKeyring creates a Keyring hashing with current, previous keys are only used
+// to check digests they made. Key IDs must be unique and can not contain KeySeparator
+func NewKeyring(current Key, previous ...Key) (*Keyring, error) {
+	k := &Keyring{}
+	seen := make(map[string]bool)
+	for _, key := range append([]Key{current}, previous...) {
+		switch {
+		case key.ID == "" || strings.Contains(key.ID, KeySeparator):
+			return nil, fmt.Errorf("hash: invalid key ID %q", key.ID)
+		case key.Secret == "":
+			return nil, fmt.Errorf("hash: key %q has no secret", key.ID)
+		case seen[key.ID]:
+			return nil, fmt.Errorf("hash: duplicate key ID %q", key.ID)
+		}
+		seen[key.ID] = true
+		k.keys = append(k.keys, keyringEntry{id: key.ID, hmac: NewHMAC(key.Secret)})
+	}
+	return k, nil
+}
+
+// CurrentID is the ID of the key new digests are made with
+func (k *Keyring) CurrentID() string {
+	return k.keys[0].id
+}
+
+// Hash hashes input with the current key, prefixing the digest with the key ID
+func (k *Keyring) Hash(input string) string {
+	return k.hashWith(k.keys[0], input)
+}
+
+// HashAll returns every digest input may have been stored as, to look it up:
+// one per key, current key first, followed by the digests without key ID
+// that were made before the keyring
+func (k *Keyring) HashAll(input string) []string {
+	digests := make([]string, 0, 2*len(k.keys))
+	legacy := make([]string, 0, len(k.keys))
+	for _, key := range k.keys {
+		digests = append(digests, k.hashWith(key, input))
+		legacy = append(legacy, key.hmac.Hash(input))
+	}
+	return append(digests, legacy...)
+}
+
+// Equal reports whether digest is the hash of input by any key of the keyring,
+// comparing in constant time. Digests without key ID are checked against every key
+func (k *Keyring) Equal(input, digest string) bool {
+	id := KeyID(digest)
+	if id == "" {
+		for _, key := range k.keys {
+			if key.hmac.Equal(input, digest) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, key := range k.keys {
+		if key.id == id {
+			return hmac.Equal([]byte(k.hashWith(key, input)), []byte(digest))
+		}
+	}
+	return false
+}
+
+// IsCurrent reports whether digest was made with the current key
+func (k *Keyring) IsCurrent(digest string) bool {
+	return KeyID(digest) == k.CurrentID()
+}
+
+// KeyID returns the ID of the key that made digest, "" if it has none
+func KeyID(digest string) string {
+	i := strings.Index(digest, KeySeparator)
+	if i < 0 {
+		return ""
+	}
+	return digest[:i]
+}
+
+func (k *Keyring) hashWith(key keyringEntry, input string) string {
+	return key.id + KeySeparator + key.hmac.Hash(input)
+}
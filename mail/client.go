@@ -0,0 +1,60 @@
+package mail
+
+import "net/url"
+
+// Client sends the emails the app needs, rendering them from views/emails
+// and delivering them through its Mailer
+type Client struct {
+	Mailer
+	From    string
+	BaseURL string
+
+	resetPw *Template
+	verify  *Template
+}
+
+// NewClient creates a Client sending as from, links in emails point to baseURL
+func NewClient(mailer Mailer, from, baseURL string) *Client {
+	return &Client{
+		Mailer:  mailer,
+		From:    from,
+		BaseURL: baseURL,
+		resetPw: NewTemplate("reset_pw"),
+		verify:  NewTemplate("verify_email"),
+	}
+}
+
+// ResetPw emails the link to reset the password with token
+func (c *Client) ResetPw(toEmail, token string) error {
+	return c.send(c.resetPw, toEmail, c.link("/reset", token))
+}
+
+// Verify emails the link to verify the address with token
+func (c *Client) Verify(toEmail, token string) error {
+	return c.send(c.verify, toEmail, c.link("/verify", token))
+}
+
+// linkData is the data of emails containing a single link
+type linkData struct {
+	URL string
+}
+
+// link builds the absolute URL of path with the token in its query string
+func (c *Client) link(path, token string) linkData {
+	v := url.Values{}
+	v.Set("token", token)
+	return linkData{
+		URL: c.BaseURL + path + "?" + v.Encode(),
+	}
+}
+
+// send renders t with data and delivers it to toEmail
+func (c *Client) send(t *Template, toEmail string, data interface{}) error {
+	msg, err := t.Render(data)
+	if err != nil {
+		return err
+	}
+	msg.From = c.From
+	msg.To = []string{toEmail}
+	return c.Send(msg)
+}
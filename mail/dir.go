@@ -0,0 +1,46 @@
+package mail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Dir writes every message to a .eml file in Path instead of sending it,
+// so emails can be opened with any mail client during development
+type Dir struct {
+	Path string
+
+	mu sync.Mutex
+	n  int
+}
+
+var _ Mailer = &Dir{}
+
+// NewDir creates a Dir mailer, the directory is created on the first Send
+func NewDir(path string) *Dir {
+	return &Dir{
+		Path: path,
+	}
+}
+
+// Send saves the message as <timestamp>-<n>.eml
+func (d *Dir) Send(msg *Message) error {
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.n++
+	name := fmt.Sprintf("%s-%d.eml", time.Now().Format("20060102-150405"), d.n)
+	d.mu.Unlock()
+
+	if err := os.MkdirAll(d.Path, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(d.Path, name), body, 0644)
+}
@@ -0,0 +1,55 @@
+package mail
+
+import "sync"
+
+// Memory keeps sent messages in memory so tests can assert on them
+type Memory struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+var _ Mailer = &Memory{}
+
+// NewMemory creates an empty Memory mailer
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Send records a copy of the message
+func (m *Memory) Send(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sent := *msg
+	sent.To = append([]string(nil), msg.To...)
+	m.sent = append(m.sent, sent)
+	return nil
+}
+
+// Messages returns every message sent so far, oldest first
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Message(nil), m.sent...)
+}
+
+// Last returns the most recently sent message, or nil if nothing was sent
+func (m *Memory) Last() *Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.sent) == 0 {
+		return nil
+	}
+	last := m.sent[len(m.sent)-1]
+	return &last
+}
+
+// Reset forgets every message sent so far
+func (m *Memory) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = nil
+}
@@ -0,0 +1,57 @@
+package mail
+
+import (
+	"fmt"
+	netmail "net/mail"
+	"net/smtp"
+)
+
+// SMTP sends messages through an SMTP server. Authentication is skipped when Username is empty
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+var _ Mailer = &SMTP{}
+
+// NewSMTP creates an SMTP mailer for the server at host:port
+func NewSMTP(host string, port int, username, password string) *SMTP {
+	return &SMTP{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+	}
+}
+
+// Send delivers the message, net/smtp upgrades to TLS when the server supports it
+func (s *SMTP) Send(msg *Message) error {
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	// the SMTP envelope wants bare addresses, headers keep the display names
+	from, err := netmail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+	to := make([]string, 0, len(msg.To))
+	for _, rcpt := range msg.To {
+		addr, err := netmail.ParseAddress(rcpt)
+		if err != nil {
+			return err
+		}
+		to = append(to, addr.Address)
+	}
+
+	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
+	return smtp.SendMail(addr, auth, from.Address, to, body)
+}
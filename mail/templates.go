@@ -0,0 +1,62 @@
+package mail
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+)
+
+var (
+	TemplateDir string = "views/emails/"
+	TemplateExt string = ".gohtml"
+	LayoutFile  string = "layout"
+)
+
+// Template renders one kind of email. Its file defines "subject" and "text", rendered
+// with text/template, and "body" which is rendered with html/template inside the
+// "html" template of the layout file, the same way views.NewView does for pages
+type Template struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+// NewTemplate parses views/emails/<name>.gohtml, panicking on errors like views.NewView
+func NewTemplate(name string) *Template {
+	file := TemplateDir + name + TemplateExt
+	layout := TemplateDir + LayoutFile + TemplateExt
+
+	html, err := htmltemplate.ParseFiles(layout, file)
+	if err != nil {
+		panic(err)
+	}
+	text, err := texttemplate.ParseFiles(file)
+	if err != nil {
+		panic(err)
+	}
+
+	return &Template{
+		html: html,
+		text: text,
+	}
+}
+
+// Render executes the template with data, returning a message without sender and recipients
+func (t *Template) Render(data interface{}) (*Message, error) {
+	var subject, text, html bytes.Buffer
+	if err := t.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := t.text.ExecuteTemplate(&text, "text", data); err != nil {
+		return nil, err
+	}
+	if err := t.html.ExecuteTemplate(&html, "html", data); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    html.String(),
+	}, nil
+}
@@ -1,22 +1,27 @@
 package main
 
 import (
+	"ecommerce/config"
 	"ecommerce/controllers"
+	"ecommerce/encrypt"
+	"ecommerce/hash"
+	"ecommerce/mail"
+	"ecommerce/middleware"
+	"ecommerce/migrations"
 	"ecommerce/models"
+	"ecommerce/payments"
+	"ecommerce/throttle"
+	"flag"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
-const (
-	host	 = "localhost"
-	port	 = 5432
-	user	 = "postgres"
-	password = "postgres"
-	dbname	 = "ecommerce_dev"
-)
-
 func must(err error) {
 	if err != nil {
 		panic(err)
@@ -24,24 +29,158 @@ func must(err error) {
 }
 
 func main() {
+	configPath := flag.String("config", ".config.json", "path to the JSON config file, ECOMMERCE_* environment variables override it")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-config file] [migrate up|down [-n N | -all]|status | rekey [-expire] | role <email> <role>]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	must(err)
+
+	// password policy
+	policy := models.PasswordPolicy{
+		MinLength:     cfg.Password.MinLength,
+		MaxLength:     cfg.Password.MaxLength,
+		DisallowEmail: cfg.Password.DisallowEmail,
+		Cost:          cfg.Password.BcryptCost,
+	}
+	if cfg.Password.BreachedFile != "" {
+		policy.Breached, err = models.LoadBreachedPasswords(cfg.Password.BreachedFile)
+		must(err)
+	}
+
+	// password peppers and token HMAC keys, current first then the retired ones
+	peppers := models.Peppers{{Version: cfg.PepperVersion, Secret: cfg.Pepper}}
+	for _, p := range cfg.PreviousPeppers {
+		peppers = append(peppers, models.Pepper{Version: p.Version, Secret: p.Pepper})
+	}
+	var previousKeys []hash.Key
+	for _, k := range cfg.PreviousHMACKeys {
+		previousKeys = append(previousKeys, hash.Key{ID: k.ID, Secret: k.Key})
+	}
+	keyring, err := hash.NewKeyring(hash.Key{ID: cfg.HMACKeyID, Secret: cfg.HMACKey}, previousKeys...)
+	must(err)
+
+	// two-factor secrets are encrypted before they are stored
+	totpCipher, err := encrypt.NewAESGCM(cfg.TOTPKey)
+	must(err)
 
-	// DB connection
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, dbname)
-	us, err := models.NewUserService(psqlInfo)
+	// DB connection, or everything in memory for development
+	storage := models.WithGorm(cfg.Database.Dialect, cfg.Database.ConnectionInfo())
+	if cfg.Database.Dialect == config.DialectMemory {
+		storage = models.WithMemory()
+	}
+	services, err := models.NewServices(
+		storage,
+		models.WithLogMode(!cfg.IsProd()),
+		models.WithUser(peppers, keyring, policy, totpCipher),
+		models.WithSession(keyring),
+		models.WithProduct(),
+		models.WithCart(),
+		models.WithOrder(),
+		models.WithInventory(),
+	)
 	if err != nil {
 		panic(err)
 	}
-	defer us.Close()
-	us.AutoMigrate()
+	defer services.Close()
+
+	// schema changes, see the migrations package. The memory store has no schema
+	if cfg.Database.Dialect == config.DialectMemory && flag.Arg(0) == "migrate" {
+		log.Fatalln("there is nothing to migrate in the memory database")
+	}
+	if cfg.Database.Dialect != config.DialectMemory {
+		migrator, err := migrations.New(services.DB(), cfg.Database.Dialect)
+		must(err)
+		if flag.Arg(0) == "migrate" {
+			must(migrate(migrator, flag.Args()[1:]))
+			return
+		}
+
+		// pending migrations are applied on start in development,
+		// production waits for someone to run "migrate up"
+		pending, err := migrator.Pending()
+		must(err)
+		if len(pending) > 0 {
+			if cfg.IsProd() {
+				log.Fatalf("%d pending migrations, run %s migrate up first", len(pending), os.Args[0])
+			}
+			applied, err := migrator.Up()
+			must(err)
+			for _, m := range applied {
+				log.Println("applied migration", m)
+			}
+		}
+	}
+
+	switch flag.Arg(0) {
+	case "rekey":
+		must(rekey(services, keyring, cfg.PepperVersion, flag.Args()[1:]))
+		return
+	case "role":
+		must(setRole(services.User, flag.Args()[1:]))
+		return
+	}
 
-	// uncomment if DB wipe is needed
-	//us.DestructiveReset()
+	// cancel orders that were never paid, putting their stock back on sale
+	go cancelExpiredOrders(services.Order, time.Minute)
 
 	// static pages handler
 	staticController := controllers.NewStatic()
 
+	// emails, rendered from views/emails
+	mailClient := mail.NewClient(newMailer(cfg.Mail), cfg.Mail.From, cfg.BaseURL)
+
+	// failed logins from one IP slow down its next attempts, whichever account they target
+	loginLimiter := throttle.NewLimiter(10, time.Second, 15*time.Minute)
+
 	// users handler
-	usersController := controllers.NewUsers(us)
+	usersController := controllers.NewUsers(services.User, services.Session, services.Cart, mailClient, loginLimiter, cfg.TOTPIssuer)
+
+	// carts handler
+	cartsController := controllers.NewCarts(services.Cart)
+
+	// payment gateway, a local fake until a real provider is configured
+	gateway := payments.NewFake(cfg.PaymentsWebhookSecret)
+
+	// orders handler
+	ordersController := controllers.NewOrders(services.Order, services.Cart, services, gateway)
+
+	// admin area handler
+	adminController := controllers.NewAdmin(services.User, services.Product, services.Order, services.Inventory, gateway)
+
+	// JSON API handler
+	apiController := controllers.NewAPI(services.User, services.Session, services.Product, services.Cart, services.Order, services, gateway, mailClient, loginLimiter)
+
+	// requests get a deadline, their queries give up once it passed
+	deadlineMw := middleware.Deadline{
+		Timeout:  time.Duration(cfg.RequestTimeout) * time.Second,
+		Services: services,
+	}
+
+	// user lookup on every request, and guards for routes needing a signed in user
+	userMw := middleware.User{
+		UserService:    services.User,
+		SessionService: services.Session,
+	}
+	requireUserMw := middleware.RequireUser{}
+	requireAPIUserMw := middleware.RequireUser{JSON: true}
+
+	// staff run the store from the admin area, each part of it needs its own
+	// permission, see models.User.Can. Customers have none of them
+	requireOrdersMw := middleware.RequirePermission{Permission: models.PermManageOrders}
+	requireProductsMw := middleware.RequirePermission{Permission: models.PermManageProducts}
+	requireInventoryMw := middleware.RequirePermission{Permission: models.PermManageInventory}
+	requireUsersMw := middleware.RequirePermission{Permission: models.PermManageUsers}
+
+	// CSRF check on every form POST, API clients using bearer tokens are exempt
+	csrfMw := middleware.CSRF{
+		Key:          []byte(cfg.CSRFKey),
+		Secure:       cfg.IsProd(),
+		ErrorHandler: http.HandlerFunc(staticController.CSRFError),
+	}
 
 	r := mux.NewRouter()
 
@@ -58,13 +197,225 @@ func main() {
 	// LOGIN
 	r.Handle("/login", usersController.LoginView).Methods("GET")
 	r.HandleFunc("/login", usersController.Login).Methods("POST")
+	r.HandleFunc("/login/totp", usersController.LoginTOTPForm).Methods("GET")
+	r.HandleFunc("/login/totp", usersController.LoginTOTP).Methods("POST")
+
+	// LOGOUT
+	r.HandleFunc("/logout", requireUserMw.ApplyFn(usersController.Logout)).Methods("POST")
+
+	// SESSIONS
+	r.HandleFunc("/sessions", requireUserMw.ApplyFn(usersController.Sessions)).Methods("GET")
+	r.HandleFunc("/sessions/{id:[0-9]+}/revoke", requireUserMw.ApplyFn(usersController.Revoke)).Methods("POST")
+
+	// TWO-FACTOR AUTHENTICATION
+	r.HandleFunc("/account/2fa", requireUserMw.ApplyFn(usersController.TwoFactor)).Methods("GET")
+	r.HandleFunc("/account/2fa/enable", requireUserMw.ApplyFn(usersController.EnableTOTP)).Methods("POST")
+	r.HandleFunc("/account/2fa/disable", requireUserMw.ApplyFn(usersController.DisableTOTP)).Methods("POST")
+	r.HandleFunc("/account/2fa/recovery-codes", requireUserMw.ApplyFn(usersController.RegenerateRecoveryCodes)).Methods("POST")
+
+	// PASSWORD RESET
+	r.Handle("/forgot", usersController.ForgotPwView).Methods("GET")
+	r.HandleFunc("/forgot", usersController.InitiateReset).Methods("POST")
+	r.HandleFunc("/reset", usersController.ResetPw).Methods("GET")
+	r.HandleFunc("/reset", usersController.CompleteReset).Methods("POST")
+
+	// EMAIL VERIFICATION
+	r.HandleFunc("/verify", usersController.Verify).Methods("GET")
+	r.HandleFunc("/verify/resend", requireUserMw.ApplyFn(usersController.ResendVerification)).Methods("POST")
+
+	// CART
+	r.HandleFunc("/cart", cartsController.Show).Methods("GET")
+	r.HandleFunc("/cart/add", cartsController.Add).Methods("POST")
+	r.HandleFunc("/cart/update", cartsController.Update).Methods("POST")
+	r.HandleFunc("/cart/remove", cartsController.Remove).Methods("POST")
+
+	// ORDERS
+	r.HandleFunc("/orders", requireUserMw.ApplyFn(ordersController.Index)).Methods("GET")
+	r.HandleFunc("/orders", requireUserMw.ApplyFn(ordersController.Create)).Methods("POST")
+	r.HandleFunc("/orders/{id:[0-9]+}", requireUserMw.ApplyFn(ordersController.Show)).Methods("GET")
 
 	// COOKIE TEST
 	r.HandleFunc("/cookietest", usersController.CookieTest).Methods("GET")
 
+	// ADMIN
+	r.Handle("/admin", http.RedirectHandler("/admin/orders", http.StatusFound)).Methods("GET")
+	admin := r.PathPrefix("/admin").Subrouter()
+	adminOrders := admin.PathPrefix("/orders").Subrouter()
+	adminOrders.Use(requireOrdersMw.Middleware)
+	adminOrders.HandleFunc("", adminController.Orders).Methods("GET")
+	adminOrders.HandleFunc("/{id:[0-9]+}", adminController.Order).Methods("GET")
+	adminOrders.HandleFunc("/{id:[0-9]+}/status", adminController.SetOrderStatus).Methods("POST")
+	adminProducts := admin.PathPrefix("/products").Subrouter()
+	adminProducts.Use(requireProductsMw.Middleware)
+	adminProducts.HandleFunc("", adminController.Products).Methods("GET")
+	adminProducts.HandleFunc("", adminController.CreateProduct).Methods("POST")
+	adminProducts.HandleFunc("/new", adminController.NewProduct).Methods("GET")
+	adminProducts.HandleFunc("/{id:[0-9]+}", adminController.EditProduct).Methods("GET")
+	adminProducts.HandleFunc("/{id:[0-9]+}", adminController.UpdateProduct).Methods("POST")
+	adminProducts.HandleFunc("/{id:[0-9]+}/delete", adminController.DeleteProduct).Methods("POST")
+	adminInventory := admin.PathPrefix("/inventory").Subrouter()
+	adminInventory.Use(requireInventoryMw.Middleware)
+	adminInventory.HandleFunc("", adminController.Inventory).Methods("GET")
+	adminInventory.HandleFunc("", adminController.SetStock).Methods("POST")
+	adminUsers := admin.PathPrefix("/users").Subrouter()
+	adminUsers.Use(requireUsersMw.Middleware)
+	adminUsers.HandleFunc("", adminController.Users).Methods("GET")
+	adminUsers.HandleFunc("/{id:[0-9]+}/role", adminController.SetRole).Methods("POST")
+
+	// JSON API
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/signup", apiController.Signup).Methods("POST")
+	api.HandleFunc("/login", apiController.Login).Methods("POST")
+	api.HandleFunc("/login/totp", apiController.LoginTOTP).Methods("POST")
+	api.HandleFunc("/logout", requireAPIUserMw.ApplyFn(apiController.Logout)).Methods("POST")
+	api.HandleFunc("/me", requireAPIUserMw.ApplyFn(apiController.Me)).Methods("GET")
+	api.HandleFunc("/verify/resend", requireAPIUserMw.ApplyFn(apiController.ResendVerification)).Methods("POST")
+	api.HandleFunc("/products", apiController.Products).Methods("GET")
+	api.HandleFunc("/products/{id:[0-9]+}", apiController.Product).Methods("GET")
+	api.HandleFunc("/cart", requireAPIUserMw.ApplyFn(apiController.Cart)).Methods("GET")
+	api.HandleFunc("/cart/items", requireAPIUserMw.ApplyFn(apiController.AddCartItem)).Methods("POST")
+	api.HandleFunc("/cart/items/{product_id:[0-9]+}", requireAPIUserMw.ApplyFn(apiController.UpdateCartItem)).Methods("PUT")
+	api.HandleFunc("/cart/items/{product_id:[0-9]+}", requireAPIUserMw.ApplyFn(apiController.RemoveCartItem)).Methods("DELETE")
+	api.HandleFunc("/orders", requireAPIUserMw.ApplyFn(apiController.Orders)).Methods("GET")
+	api.HandleFunc("/orders", requireAPIUserMw.ApplyFn(apiController.CreateOrder)).Methods("POST")
+	api.HandleFunc("/orders/{id:[0-9]+}", requireAPIUserMw.ApplyFn(apiController.Order)).Methods("GET")
+	api.HandleFunc("/payments/webhook", apiController.PaymentsWebhook).Methods("POST")
+	api.NotFoundHandler = http.HandlerFunc(apiController.NotFound)
+
 	// 404
 	r.NotFoundHandler = staticController.Error404View
 
 	// Server start
-	http.ListenAndServe(":3000", r)
+	log.Printf("listening on %s\n", cfg.Addr())
+	http.ListenAndServe(cfg.Addr(), deadlineMw.Apply(userMw.Apply(csrfMw.Apply(r))))
+}
+
+// cancelExpiredOrders periodically cancels abandoned checkouts whose stock reservation
+// expired, putting the stock back on sale
+func cancelExpiredOrders(orders models.OrderService, every time.Duration) {
+	for range time.Tick(every) {
+		n, err := orders.CancelExpired(time.Now())
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("cancelled %d orders whose stock reservation expired\n", n)
+		}
+	}
+}
+
+// newMailer builds the mail backend selected in the configuration
+func newMailer(cfg config.MailConfig) mail.Mailer {
+	switch cfg.Backend {
+	case config.MailSMTP:
+		return mail.NewSMTP(cfg.SMTP.Host, cfg.SMTP.Port, cfg.SMTP.Username, cfg.SMTP.Password)
+	case config.MailMemory:
+		return mail.NewMemory()
+	default:
+		return mail.NewDir(cfg.Dir)
+	}
+}
+
+// rekey reports the stored hashes still depending on retired keys, and with -expire
+// deletes the sessions and password resets made with them, see models.Services.Rekey
+func rekey(services *models.Services, keyring *hash.Keyring, pepperVersion int, args []string) error {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	expire := fs.Bool("expire", false, "delete sessions and password resets hashed with retired HMAC keys")
+	fs.Parse(args)
+
+	report, err := services.Rekey(keyring, pepperVersion, *expire)
+	if err != nil {
+		return err
+	}
+
+	action := "still using"
+	if *expire {
+		action = "deleted, were using"
+	}
+	fmt.Printf("sessions %s retired HMAC keys: %d\n", action, report.Sessions)
+	fmt.Printf("password resets %s retired HMAC keys: %d\n", action, report.PasswordResets)
+	fmt.Printf("unused recovery codes hashed with retired HMAC keys: %d\n", report.RecoveryCodes)
+	if report.RecoveryCodes > 0 {
+		fmt.Println("  they stop working once their key is removed, their users can generate new ones")
+	}
+	fmt.Printf("users with a password hashed with a retired pepper: %d\n", report.Users)
+	if report.Users > 0 {
+		fmt.Println("  their passwords are re-hashed on their next login, keep the previous peppers until then")
+	}
+	return nil
+}
+
+// setRole gives the user with the email one of models.Roles, it is how the first admin is made
+func setRole(us models.UserService, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s role <email> <%s>", os.Args[0], strings.Join(models.Roles, "|"))
+	}
+
+	user, err := us.ByEmail(args[0])
+	if err != nil {
+		return err
+	}
+	user.Role = args[1]
+	if err := us.Update(user); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s is now %s\n", user.Email, user.Role)
+	if user.NeedsTOTP() {
+		fmt.Println("  they must turn on two-factor authentication before using the admin area")
+	}
+	return nil
+}
+
+// migrate runs the migrate subcommand: up applies every pending migration,
+// down rolls back the last one, or the last -n or -all of them, and status
+// lists every migration with when it was applied
+func migrate(m *migrations.Migrator, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s migrate up|down|status", os.Args[0])
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := m.Up()
+		for _, migration := range applied {
+			fmt.Println("applied", migration)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return err
+	case "down":
+		fs := flag.NewFlagSet("migrate down", flag.ExitOnError)
+		n := fs.Int("n", 1, "number of migrations to roll back")
+		all := fs.Bool("all", false, "roll back every migration, dropping all the data")
+		fs.Parse(args[1:])
+		if *all {
+			*n = 0
+		} else if *n < 1 {
+			return fmt.Errorf("migrate down: -n must be 1 or more")
+		}
+
+		rolledBack, err := m.Down(*n)
+		for _, migration := range rolledBack {
+			fmt.Println("rolled back", migration)
+		}
+		return err
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			if status.AppliedAt == nil {
+				fmt.Printf("%-40s pending\n", status.Migration)
+				continue
+			}
+			fmt.Printf("%-40s applied %s\n", status.Migration, status.AppliedAt.Format("2006-01-02 15:04:05"))
+		}
+		return nil
+	default:
+		return fmt.Errorf("migrate: unknown command %q, use up, down or status", args[0])
+	}
 }
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/csrf"
+)
+
+func TestCSRFFormPost(t *testing.T) {
+	tests := []struct {
+		name   string
+		origin string
+		token  bool
+		want   int
+	}{
+		{"same origin with token", "http://localhost:3000", true, http.StatusOK},
+		{"same origin without token", "http://localhost:3000", false, http.StatusForbidden},
+		{"other origin with token", "http://evil.example.com", true, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var token string
+			mw := CSRF{
+				Key: []byte("0123456789abcdef0123456789abcdef"),
+				ErrorHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					http.Error(w, csrf.FailureReason(r).Error(), http.StatusForbidden)
+				}),
+			}
+			handler := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+				token = csrf.Token(r)
+			})
+
+			// the form is served first, setting the CSRF cookie
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "http://localhost:3000/signup", nil))
+			cookies := rec.Result().Cookies()
+
+			form := url.Values{"email": {"jon@example.com"}}
+			if tt.token {
+				form.Set("gorilla.csrf.Token", token)
+			}
+			r := httptest.NewRequest(http.MethodPost, "http://localhost:3000/signup", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Origin", tt.origin)
+			for _, cookie := range cookies {
+				r.AddCookie(cookie)
+			}
+			rec = httptest.NewRecorder()
+			handler(rec, r)
+			if rec.Code != tt.want {
+				t.Fatalf("got status %d (%s), want %d", rec.Code, strings.TrimSpace(rec.Body.String()), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"ecommerce/models"
+)
+
+// Deadline gives the context of every request a deadline of Timeout. The context is
+// already cancelled when the client goes away, with the deadline a slow query can not
+// hold a request, and its database connection, longer than Timeout either: the
+// Context methods of the services give up on it with context.DeadlineExceeded.
+// Services, when set, open the connection used by those methods once per request
+type Deadline struct {
+	Timeout  time.Duration
+	Services *models.Services
+}
+
+func (mw *Deadline) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *Deadline) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), mw.Timeout)
+		defer cancel()
+		if mw.Services != nil {
+			ctx = mw.Services.WithContext(ctx)
+		}
+		next(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"net/http"
+
+	"ecommerce/models"
+)
+
+// RequirePermission assumes User has already been run and lets the request through only
+// when the role of the signed in user grants Permission, see models.User.Can. Signed out
+// browsers are redirected to /login and users without the permission get a 403. Users whose
+// role needs two-factor authentication, see models.User.NeedsTOTP, are sent to set it up first.
+// With JSON set errors are JSON, like RequireUser. Middleware can be passed to the Use method
+// of mux subrouters
+type RequirePermission struct {
+	Permission models.Permission
+	JSON       bool
+}
+
+func (mw *RequirePermission) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RequirePermission) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return requireAllowed(mw.JSON, func(user *models.User) bool {
+		return user.Can(mw.Permission)
+	}, next)
+}
+
+// Middleware is Apply with the signature of mux.MiddlewareFunc
+func (mw *RequirePermission) Middleware(next http.Handler) http.Handler {
+	return mw.Apply(next)
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"ecommerce/context"
+	"ecommerce/models"
+)
+
+// RequireRole assumes User has already been run and lets the request through only when
+// the signed in user has one of Roles. It behaves like RequirePermission otherwise.
+// Middleware can be passed to the Use method of mux subrouters
+type RequireRole struct {
+	Roles []string
+	JSON  bool
+}
+
+func (mw *RequireRole) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RequireRole) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return requireAllowed(mw.JSON, func(user *models.User) bool {
+		return user.HasRole(mw.Roles...)
+	}, next)
+}
+
+// Middleware is Apply with the signature of mux.MiddlewareFunc
+func (mw *RequireRole) Middleware(next http.Handler) http.Handler {
+	return mw.Apply(next)
+}
+
+// requireAllowed is the check behind RequireRole and RequirePermission, it lets the
+// request through only when a user is signed in, allowed returns true for them and
+// they do not need to turn on two-factor authentication first
+func requireAllowed(asJSON bool, allowed func(user *models.User) bool, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		switch {
+		case user == nil:
+			if asJSON {
+				writeJSONError(w, http.StatusUnauthorized, "Authentication required")
+				return
+			}
+			http.Redirect(w, r, "/login", http.StatusFound)
+		case !allowed(user):
+			if asJSON {
+				writeJSONError(w, http.StatusForbidden, "You are not allowed to do this")
+				return
+			}
+			http.Error(w, "You are not allowed to see this page", http.StatusForbidden)
+		case user.NeedsTOTP():
+			if asJSON {
+				writeJSONError(w, http.StatusForbidden, "Two-factor authentication must be turned on first")
+				return
+			}
+			http.Redirect(w, r, "/account/2fa", http.StatusFound)
+		default:
+			next(w, r)
+		}
+	})
+}
+
+// writeJSONError writes {"error": msg} with the status
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ecommerce/context"
+	"ecommerce/models"
+)
+
+func TestRequireAllowed(t *testing.T) {
+	customer := &models.User{Role: models.RoleCustomer}
+	staff := &models.User{Role: models.RoleStaff}
+	admin := &models.User{Role: models.RoleAdmin, TOTPEnabled: true}
+	adminWithoutTOTP := &models.User{Role: models.RoleAdmin}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	staffOnly := &RequireRole{Roles: []string{models.RoleStaff, models.RoleAdmin}}
+	manageUsers := &RequirePermission{Permission: models.PermManageUsers}
+	manageUsersJSON := &RequirePermission{Permission: models.PermManageUsers, JSON: true}
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		user     *models.User
+		want     int
+		location string
+	}{
+		{"role signed out", staffOnly.ApplyFn(ok), nil, http.StatusFound, "/login"},
+		{"role not held", staffOnly.ApplyFn(ok), customer, http.StatusForbidden, ""},
+		{"role held", staffOnly.ApplyFn(ok), staff, http.StatusOK, ""},
+		{"permission signed out", manageUsers.ApplyFn(ok), nil, http.StatusFound, "/login"},
+		{"permission not granted", manageUsers.ApplyFn(ok), staff, http.StatusForbidden, ""},
+		{"permission granted", manageUsers.ApplyFn(ok), admin, http.StatusOK, ""},
+		{"two-factor needed", manageUsers.ApplyFn(ok), adminWithoutTOTP, http.StatusFound, "/account/2fa"},
+		{"JSON signed out", manageUsersJSON.ApplyFn(ok), nil, http.StatusUnauthorized, ""},
+		{"JSON two-factor needed", manageUsersJSON.ApplyFn(ok), adminWithoutTOTP, http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/admin/users", nil)
+			if tt.user != nil {
+				r = r.WithContext(context.WithUser(r.Context(), tt.user))
+			}
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d", w.Code, tt.want)
+			}
+			if location := w.Header().Get("Location"); location != tt.location {
+				t.Fatalf("got redirect to %q, want %q", location, tt.location)
+			}
+		})
+	}
+}
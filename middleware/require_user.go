@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"ecommerce/context"
+	"ecommerce/models"
+)
+
+// User looks up the session on every request, from the remember_token cookie or an
+// "Authorization: Bearer <token>" header, and stores it and its user in the request context.
+// Requests without a valid token carry on without a user
+type User struct {
+	models.UserService
+	models.SessionService
+}
+
+func (mw *User) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := rememberToken(r)
+		if token == "" {
+			next(w, r)
+			return
+		}
+
+		session, err := mw.SessionService.ByToken(token)
+		if err != nil {
+			next(w, r)
+			return
+		}
+
+		user, err := mw.UserService.ByIDContext(r.Context(), session.UserID)
+		if err != nil {
+			next(w, r)
+			return
+		}
+
+		if err := mw.SessionService.Touch(session); err != nil {
+			log.Println(err)
+		}
+
+		ctx := context.WithUser(r.Context(), user)
+		ctx = context.WithSession(ctx, session)
+		next(w, r.WithContext(ctx))
+	})
+}
+
+// RequireUser assumes User has already been run and lets the request through only when
+// a user is signed in. Otherwise browsers are redirected to /login and, when JSON is set,
+// API clients get a 401 with a JSON error instead
+type RequireUser struct {
+	JSON bool
+}
+
+func (mw *RequireUser) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if context.User(r.Context()) != nil {
+			next(w, r)
+			return
+		}
+
+		if mw.JSON {
+			writeJSONError(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		http.Redirect(w, r, "/login", http.StatusFound)
+	})
+}
+
+// rememberToken returns the bearer token of the Authorization header if present,
+// falling back to the remember_token cookie. The API is bearer only: it is exempt
+// from the CSRF check, a cookie would let other sites make requests as the user
+func rememberToken(r *http.Request) string {
+	if token := bearerToken(r); token != "" || isAPI(r) {
+		return token
+	}
+
+	cookie, err := r.Cookie("remember_token")
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// isAPI reports whether r is a request to the JSON API
+func isAPI(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// bearerToken returns the token of an "Authorization: Bearer <token>" header, or ""
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return strings.TrimSpace(auth[len(prefix):])
+	}
+	return ""
+}
@@ -0,0 +1,340 @@
+// Package migrations evolves the database schema with the versioned SQL files
+// embedded from sql/<dialect>/. Each migration is a pair of files, NNNN_name.up.sql and
+// NNNN_name.down.sql, applied in version order and recorded in schema_migrations.
+// Every dialect has its own copy of each migration, written for that database
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed sql/*/*.sql
+var files embed.FS
+
+// lockID is the Postgres advisory lock held while migrating, any constant works
+// as long as every instance of the app uses the same one
+const lockID = 72616571
+
+// dialect holds the SQL that differs between databases, keyed by gorm dialect name
+type dialect struct {
+	// lock and unlock keep other instances from migrating at the same time. SQLite
+	// has none, its file is not shared by instances and it locks itself while written
+	lock, unlock string
+
+	// timestamp is the column type the driver reads back as a time.Time
+	timestamp string
+
+	// numbered uses the placeholders $1, $2... instead of ?
+	numbered bool
+}
+
+var dialects = map[string]dialect{
+	"postgres": {
+		lock:      "SELECT pg_advisory_lock(?)",
+		unlock:    "SELECT pg_advisory_unlock(?)",
+		timestamp: "timestamp with time zone",
+		numbered:  true,
+	},
+	"sqlite3": {
+		timestamp: "datetime",
+	},
+}
+
+// rebind rewrites the ? placeholders of query for the dialect
+func (d dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var sb strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&sb, "$%d", n)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one schema change and the SQL undoing it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Status is a migration and when it was applied, AppliedAt is nil while it is pending
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrator applies the embedded migrations to a database
+type Migrator struct {
+	db         *sql.DB
+	dialect    dialect
+	migrations []Migration
+}
+
+// New creates a Migrator for db with the migrations embedded in the binary for
+// dialectName, the gorm name of the database: postgres or sqlite3
+func New(db *sql.DB, dialectName string) (*Migrator, error) {
+	d, ok := dialects[dialectName]
+	if !ok {
+		return nil, fmt.Errorf("migrations: unsupported dialect %q", dialectName)
+	}
+	migrations, err := load(files, path.Join("sql", dialectName))
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		db:         db,
+		dialect:    d,
+		migrations: migrations,
+	}, nil
+}
+
+// load reads the migrations in dir of fsys, sorted by version. Every version
+// needs both an up and a down file
+func load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migrations: unexpected file %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		body, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migrations: version %d is used by both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migrations: %s needs both an up and a down file", m)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Up applies every pending migration in order, returning the ones applied.
+// Each migration runs in its own transaction, so a failing one leaves the
+// schema at the previous version
+func (m *Migrator) Up() ([]Migration, error) {
+	var applied []Migration
+	err := m.locked(func(conn *sql.Conn) error {
+		versions, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := versions[migration.Version]; ok {
+				continue
+			}
+			err := inTx(conn, func(tx *sql.Tx) error {
+				if _, err := tx.Exec(migration.Up); err != nil {
+					return err
+				}
+				_, err := tx.Exec(m.dialect.rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"),
+					migration.Version, migration.Name, time.Now())
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migrations: applying %s: %v", migration, err)
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down rolls back the n most recently applied migrations, newest first, or all of them
+// when n is 0 or less. It returns the migrations rolled back
+func (m *Migrator) Down(n int) ([]Migration, error) {
+	var rolledBack []Migration
+	err := m.locked(func(conn *sql.Conn) error {
+		versions, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			if n > 0 && len(rolledBack) == n {
+				break
+			}
+			migration := m.migrations[i]
+			if _, ok := versions[migration.Version]; !ok {
+				continue
+			}
+			err := inTx(conn, func(tx *sql.Tx) error {
+				if _, err := tx.Exec(migration.Down); err != nil {
+					return err
+				}
+				_, err := tx.Exec(m.dialect.rebind("DELETE FROM schema_migrations WHERE version = ?"), migration.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migrations: rolling back %s: %v", migration, err)
+			}
+			delete(versions, migration.Version)
+			rolledBack = append(rolledBack, migration)
+		}
+
+		// left over versions were applied by a newer build, which has their down SQL
+		if n <= 0 && len(versions) > 0 {
+			return fmt.Errorf("migrations: %d applied migrations are unknown to this build", len(versions))
+		}
+		return nil
+	})
+	return rolledBack, err
+}
+
+// Status lists every migration with when it was applied
+func (m *Migrator) Status() ([]Status, error) {
+	var statuses []Status
+	err := m.locked(func(conn *sql.Conn) error {
+		versions, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			status := Status{Migration: migration}
+			if appliedAt, ok := versions[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Pending lists the migrations not applied yet
+func (m *Migrator) Pending() ([]Migration, error) {
+	statuses, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			pending = append(pending, status.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// Reset rolls back every migration and applies them again, leaving an empty database
+func (m *Migrator) Reset() error {
+	if _, err := m.Down(0); err != nil {
+		return err
+	}
+	_, err := m.Up()
+	return err
+}
+
+// locked runs fn on a single connection holding the advisory lock, so two instances
+// starting at the same time can not both migrate. The lock belongs to the connection,
+// which is why everything has to go through conn
+func (m *Migrator) locked(fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.dialect.lock != "" {
+		if _, err := conn.ExecContext(ctx, m.dialect.rebind(m.dialect.lock), lockID); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, m.dialect.rebind(m.dialect.unlock), lockID)
+	}
+
+	_, err = conn.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name varchar(255) NOT NULL,
+		applied_at %s NOT NULL
+	)`, m.dialect.timestamp))
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// appliedVersions maps the version of every applied migration to when it was applied
+func appliedVersions(conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(context.Background(), "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		versions[version] = appliedAt
+	}
+	return versions, rows.Err()
+}
+
+// inTx runs fn in a transaction on conn, committing only if it succeeds
+func inTx(conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
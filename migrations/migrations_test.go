@@ -0,0 +1,118 @@
+package migrations
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// baselineUser is the user model as it was before migrations, when gorm
+// AutoMigrate created the schema
+type baselineUser struct {
+	gorm.Model
+	Name         string
+	Email        string `gorm:"not null;unique_index"`
+	PasswordHash string `gorm:"not null"`
+	RememberHash string `gorm:"not null;unique_index"`
+}
+
+func (baselineUser) TableName() string {
+	return "users"
+}
+
+// openSQLite opens a new SQLite database in the test's temporary directory
+func openSQLite(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestUpAdoptsAutoMigrate(t *testing.T) {
+	db := openSQLite(t)
+	if err := db.AutoMigrate(&baselineUser{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	existing := baselineUser{Name: "Jon Calhoun", Email: "jon@example.com", PasswordHash: "hash", RememberHash: "remember"}
+	if err := db.Create(&existing).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New(db.DB(), "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	var user struct {
+		ID           uint
+		Email        string
+		PasswordHash string
+		Role         string
+		FailedLogins int
+		TOTPEnabled  bool  `gorm:"column:totp_enabled"`
+		TOTPLastStep int64 `gorm:"column:totp_last_step"`
+	}
+	if err := db.Table("users").Where("email = ?", "jon@example.com").First(&user).Error; err != nil {
+		t.Fatalf("reading the adopted user: %v", err)
+	}
+	if user.ID != existing.ID || user.PasswordHash != "hash" || user.Role != "customer" {
+		t.Fatalf("got user %+v, want ID %d with its hash and the customer role", user, existing.ID)
+	}
+	if db.Dialect().HasColumn("users", "remember_hash") {
+		t.Fatal("remember_hash was not dropped")
+	}
+
+	// new users continue after the adopted IDs
+	err = db.Exec("INSERT INTO users (email, password_hash) VALUES (?, ?)", "jane@example.com", "hash").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.Table("users").Where("id > ?", existing.ID).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("got %d users after the adopted one, want 1", count)
+	}
+}
+
+func TestUpDownUp(t *testing.T) {
+	db := openSQLite(t)
+	m, err := New(db.DB(), "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := m.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(m.migrations) {
+		t.Fatalf("applied %d migrations, want %d", len(applied), len(m.migrations))
+	}
+	if _, err := m.Down(0); err != nil {
+		t.Fatal(err)
+	}
+	if db.HasTable("users") {
+		t.Fatal("users was not dropped by Down")
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("applying again: %v", err)
+	}
+	pending, err := m.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("got %d pending migrations, want none", len(pending))
+	}
+}
@@ -0,0 +1,171 @@
+-- Baseline schema. Every statement only creates what is missing, so databases made
+-- by gorm AutoMigrate are adopted: their users table gets the columns added since
+
+CREATE TABLE IF NOT EXISTS users (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    name varchar(255),
+    email varchar(255) NOT NULL,
+    role varchar(255) NOT NULL DEFAULT 'customer',
+    password_hash varchar(255) NOT NULL,
+    email_verified_at timestamp with time zone,
+    pepper_version integer NOT NULL DEFAULT 0,
+    failed_logins integer NOT NULL DEFAULT 0,
+    locked_until timestamp with time zone,
+    totp_secret_encrypted varchar(255),
+    totp_enabled boolean NOT NULL DEFAULT false,
+    totp_last_step bigint NOT NULL DEFAULT 0
+);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role varchar(255) NOT NULL DEFAULT 'customer';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at timestamp with time zone;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pepper_version integer NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_logins integer NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until timestamp with time zone;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret_encrypted varchar(255);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step bigint NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_users_email ON users (email);
+
+-- remember tokens moved to the sessions table
+ALTER TABLE users DROP COLUMN IF EXISTS remember_hash;
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id integer NOT NULL,
+    token_hash varchar(255) NOT NULL,
+    user_agent varchar(255),
+    ip varchar(255),
+    last_seen_at timestamp with time zone,
+    expires_at timestamp with time zone NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_deleted_at ON sessions (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_sessions_token_hash ON sessions (token_hash);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions (expires_at);
+
+CREATE TABLE IF NOT EXISTS password_resets (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id integer NOT NULL,
+    token_hash varchar(255) NOT NULL,
+    expires_at timestamp with time zone NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_password_resets_deleted_at ON password_resets (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_password_resets_user_id ON password_resets (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_password_resets_token_hash ON password_resets (token_hash);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id integer NOT NULL,
+    code_hash varchar(255) NOT NULL,
+    used_at timestamp with time zone
+);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_deleted_at ON recovery_codes (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_recovery_codes_code_hash ON recovery_codes (code_hash);
+
+CREATE TABLE IF NOT EXISTS products (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    name varchar(255) NOT NULL,
+    sku varchar(255) NOT NULL,
+    slug varchar(255) NOT NULL,
+    description varchar(255),
+    price integer NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_products_deleted_at ON products (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_products_sku ON products (sku);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_products_slug ON products (slug);
+
+CREATE TABLE IF NOT EXISTS carts (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id integer,
+    token varchar(255) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_carts_deleted_at ON carts (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_carts_user_id ON carts (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_carts_token ON carts (token);
+
+CREATE TABLE IF NOT EXISTS cart_items (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    cart_id integer NOT NULL,
+    product_id integer NOT NULL,
+    quantity integer NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_cart_items_deleted_at ON cart_items (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_cart_items_cart_id ON cart_items (cart_id);
+
+CREATE TABLE IF NOT EXISTS orders (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id integer NOT NULL,
+    status varchar(255) NOT NULL,
+    total integer NOT NULL,
+    payment_id varchar(255)
+);
+CREATE INDEX IF NOT EXISTS idx_orders_deleted_at ON orders (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_orders_user_id ON orders (user_id);
+CREATE INDEX IF NOT EXISTS idx_orders_status ON orders (status);
+CREATE INDEX IF NOT EXISTS idx_orders_payment_id ON orders (payment_id);
+
+CREATE TABLE IF NOT EXISTS order_items (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    order_id integer NOT NULL,
+    product_id integer NOT NULL,
+    name varchar(255) NOT NULL,
+    sku varchar(255) NOT NULL,
+    price integer NOT NULL,
+    quantity integer NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_order_items_deleted_at ON order_items (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_order_items_order_id ON order_items (order_id);
+
+CREATE TABLE IF NOT EXISTS stocks (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    sku varchar(255) NOT NULL,
+    on_hand integer NOT NULL,
+    reserved integer NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_stocks_deleted_at ON stocks (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_stocks_sku ON stocks (sku);
+
+CREATE TABLE IF NOT EXISTS reservations (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    order_id integer NOT NULL,
+    sku varchar(255) NOT NULL,
+    quantity integer NOT NULL,
+    expires_at timestamp with time zone NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_reservations_deleted_at ON reservations (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_reservations_order_id ON reservations (order_id);
+CREATE INDEX IF NOT EXISTS idx_reservations_expires_at ON reservations (expires_at);
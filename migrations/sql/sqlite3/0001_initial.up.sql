@@ -0,0 +1,185 @@
+-- Baseline schema, the same tables and indexes as the postgres one with SQLite
+-- column types. Times are datetime so the driver reads them back as time.Time
+
+CREATE TABLE IF NOT EXISTS users (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    name varchar(255),
+    email varchar(255) NOT NULL,
+    role varchar(255) NOT NULL DEFAULT 'customer',
+    password_hash varchar(255) NOT NULL,
+    email_verified_at datetime,
+    pepper_version integer NOT NULL DEFAULT 0,
+    failed_logins integer NOT NULL DEFAULT 0,
+    locked_until datetime,
+    totp_secret_encrypted varchar(255),
+    totp_enabled boolean NOT NULL DEFAULT 0,
+    totp_last_step bigint NOT NULL DEFAULT 0
+);
+
+-- SQLite can not add a column only if it is missing, so users is rebuilt from the
+-- columns gorm AutoMigrate created. A users table made by AutoMigrate gets the new
+-- columns and loses remember_hash, a new one is empty and copied as it is
+CREATE TABLE users_adopted (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    name varchar(255),
+    email varchar(255) NOT NULL,
+    role varchar(255) NOT NULL DEFAULT 'customer',
+    password_hash varchar(255) NOT NULL,
+    email_verified_at datetime,
+    pepper_version integer NOT NULL DEFAULT 0,
+    failed_logins integer NOT NULL DEFAULT 0,
+    locked_until datetime,
+    totp_secret_encrypted varchar(255),
+    totp_enabled boolean NOT NULL DEFAULT 0,
+    totp_last_step bigint NOT NULL DEFAULT 0
+);
+INSERT INTO users_adopted (id, created_at, updated_at, deleted_at, name, email, password_hash)
+    SELECT id, created_at, updated_at, deleted_at, name, email, password_hash FROM users;
+DROP TABLE users;
+ALTER TABLE users_adopted RENAME TO users;
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_users_email ON users (email);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    user_id integer NOT NULL,
+    token_hash varchar(255) NOT NULL,
+    user_agent varchar(255),
+    ip varchar(255),
+    last_seen_at datetime,
+    expires_at datetime NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_deleted_at ON sessions (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_sessions_token_hash ON sessions (token_hash);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions (expires_at);
+
+CREATE TABLE IF NOT EXISTS password_resets (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    user_id integer NOT NULL,
+    token_hash varchar(255) NOT NULL,
+    expires_at datetime NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_password_resets_deleted_at ON password_resets (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_password_resets_user_id ON password_resets (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_password_resets_token_hash ON password_resets (token_hash);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    user_id integer NOT NULL,
+    code_hash varchar(255) NOT NULL,
+    used_at datetime
+);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_deleted_at ON recovery_codes (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_recovery_codes_code_hash ON recovery_codes (code_hash);
+
+CREATE TABLE IF NOT EXISTS products (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    name varchar(255) NOT NULL,
+    sku varchar(255) NOT NULL,
+    slug varchar(255) NOT NULL,
+    description varchar(255),
+    price integer NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_products_deleted_at ON products (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_products_sku ON products (sku);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_products_slug ON products (slug);
+
+CREATE TABLE IF NOT EXISTS carts (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    user_id integer,
+    token varchar(255) NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_carts_deleted_at ON carts (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_carts_user_id ON carts (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_carts_token ON carts (token);
+
+CREATE TABLE IF NOT EXISTS cart_items (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    cart_id integer NOT NULL,
+    product_id integer NOT NULL,
+    quantity integer NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_cart_items_deleted_at ON cart_items (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_cart_items_cart_id ON cart_items (cart_id);
+
+CREATE TABLE IF NOT EXISTS orders (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    user_id integer NOT NULL,
+    status varchar(255) NOT NULL,
+    total integer NOT NULL,
+    payment_id varchar(255)
+);
+CREATE INDEX IF NOT EXISTS idx_orders_deleted_at ON orders (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_orders_user_id ON orders (user_id);
+CREATE INDEX IF NOT EXISTS idx_orders_status ON orders (status);
+CREATE INDEX IF NOT EXISTS idx_orders_payment_id ON orders (payment_id);
+
+CREATE TABLE IF NOT EXISTS order_items (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    order_id integer NOT NULL,
+    product_id integer NOT NULL,
+    name varchar(255) NOT NULL,
+    sku varchar(255) NOT NULL,
+    price integer NOT NULL,
+    quantity integer NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_order_items_deleted_at ON order_items (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_order_items_order_id ON order_items (order_id);
+
+CREATE TABLE IF NOT EXISTS stocks (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    sku varchar(255) NOT NULL,
+    on_hand integer NOT NULL,
+    reserved integer NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_stocks_deleted_at ON stocks (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_stocks_sku ON stocks (sku);
+
+CREATE TABLE IF NOT EXISTS reservations (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    order_id integer NOT NULL,
+    sku varchar(255) NOT NULL,
+    quantity integer NOT NULL,
+    expires_at datetime NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_reservations_deleted_at ON reservations (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_reservations_order_id ON reservations (order_id);
+CREATE INDEX IF NOT EXISTS idx_reservations_expires_at ON reservations (expires_at);
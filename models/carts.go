@@ -0,0 +1,403 @@
+package models
+
+import (
+	"ecommerce/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+const cartTokenBytes = 32
+
+var (
+	// ErrQuantityInvalid is returned when a cart item is added or updated with a quantity lower than one
+	ErrQuantityInvalid modelError = "models: quantity must be greater than zero"
+
+	// ErrCartCheckedOut is returned by Claim when another checkout claimed the cart first
+	ErrCartCheckedOut modelError = "models: this cart is already being checked out"
+)
+
+// Cart holds the items a visitor intends to buy. Every cart gets a random Token so anonymous
+// visitors can be identified by cookie; carts belonging to a signed in user also have UserID set
+type Cart struct {
+	gorm.Model
+	UserID uint   `gorm:"index"`
+	Token  string `gorm:"not null;unique_index"`
+	Items  []CartItem
+}
+
+// CartItem is a product and quantity inside a cart
+type CartItem struct {
+	gorm.Model
+	CartID    uint `gorm:"not null;index"`
+	ProductID uint `gorm:"not null"`
+	Product   Product
+	Quantity  int `gorm:"not null"`
+}
+
+// Subtotal is the item price multiplied by the quantity, in cents
+func (ci CartItem) Subtotal() int {
+	return ci.Product.Price * ci.Quantity
+}
+
+// Total is the sum of all item subtotals, in cents
+func (c Cart) Total() int {
+	total := 0
+	for _, item := range c.Items {
+		total += item.Subtotal()
+	}
+	return total
+}
+
+type CartDB interface {
+	// Methods for querying carts, items and their products are preloaded
+	ByID(id uint) (*Cart, error)
+	ByUserID(userID uint) (*Cart, error)
+	ByToken(token string) (*Cart, error)
+
+	// Methods for altering carts
+	Create(cart *Cart) error
+	Update(cart *Cart) error
+	Delete(id uint) error
+
+	// Claim takes the cart out of use for a checkout, only one checkout can claim it.
+	// Restore puts a claimed cart back with its items when the checkout fails
+	Claim(id uint) error
+	Restore(id uint) error
+
+	// Methods for altering items inside a cart
+	AddItem(item *CartItem) error
+	UpdateItem(item *CartItem) error
+	RemoveItem(item *CartItem) error
+}
+
+type CartService interface {
+	// Merge moves the items of the anonymous cart identified by token
+	// into the cart of the user, creating it if needed
+	Merge(token string, userID uint) error
+	CartDB
+}
+
+type cartService struct {
+	CartDB
+}
+
+type cartValidator struct {
+	CartDB
+	products ProductDB
+}
+
+type cartGorm struct {
+	db *gorm.DB
+}
+
+var _ CartDB = &cartGorm{}
+var _ CartService = &cartService{}
+
+type cartValFn func(*Cart) error
+type cartItemValFn func(*CartItem) error
+
+// NewCartService builds a CartService on top of the connection shared by Services
+func NewCartService(db *gorm.DB) CartService {
+	return newCartService(&cartGorm{db: db}, &productGorm{db: db})
+}
+
+func newCartService(db CartDB, products ProductDB) CartService {
+	return &cartService{
+		CartDB: &cartValidator{
+			CartDB:   db,
+			products: products,
+		},
+	}
+}
+
+// preload makes sure cart items and their products are loaded alongside the cart
+func (cg *cartGorm) preload() *gorm.DB {
+	return cg.db.Preload("Items").Preload("Items.Product")
+}
+
+// ByID will look up a cart with the provided ID
+// If the cart is not found, return ErrNotFound
+func (cg *cartGorm) ByID(id uint) (*Cart, error) {
+	var cart Cart
+	err := first(cg.preload().Where("id = ?", id), &cart)
+	if err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// ByUserID will look up the cart belonging to the user with the provided ID
+// Errors are the same as ByID
+func (cg *cartGorm) ByUserID(userID uint) (*Cart, error) {
+	var cart Cart
+	err := first(cg.preload().Where("user_id = ?", userID), &cart)
+	if err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// ByToken will look up the cart with the provided token
+// Errors are the same as ByID
+func (cg *cartGorm) ByToken(token string) (*Cart, error) {
+	var cart Cart
+	err := first(cg.preload().Where("token = ?", token), &cart)
+	if err != nil {
+		return nil, err
+	}
+	return &cart, nil
+}
+
+// Create will create the provided cart and backfill data like the ID, CreatedAt, UpdatedAt fields
+func (cg *cartGorm) Create(cart *Cart) error {
+	return cg.db.Create(cart).Error
+}
+func (cv *cartValidator) Create(cart *Cart) error {
+	if err := runCartValFns(cart, cv.setTokenIfUnset); err != nil {
+		return err
+	}
+
+	return cv.CartDB.Create(cart)
+}
+
+// Update will save the cart itself, items are changed through the item methods
+func (cg *cartGorm) Update(cart *Cart) error {
+	return cg.db.Set("gorm:save_associations", false).Save(cart).Error
+}
+func (cv *cartValidator) Update(cart *Cart) error {
+	if err := runCartValFns(cart, cv.idGreaterThan(0), cv.setTokenIfUnset); err != nil {
+		return err
+	}
+
+	return cv.CartDB.Update(cart)
+}
+
+// Delete will delete the cart with the provided ID along with its items
+func (cg *cartGorm) Delete(id uint) error {
+	err := cg.db.Where("cart_id = ?", id).Delete(&CartItem{}).Error
+	if err != nil {
+		return err
+	}
+	cart := Cart{Model: gorm.Model{ID: id}}
+	return cg.db.Delete(&cart).Error
+}
+func (cv *cartValidator) Delete(id uint) error {
+	var cart Cart
+	cart.ID = id
+	if err := runCartValFns(&cart, cv.idGreaterThan(0)); err != nil {
+		return err
+	}
+
+	return cv.CartDB.Delete(id)
+}
+
+// Claim will delete the cart, keeping its items, only if it was not deleted yet.
+// If another checkout claimed it first, this will return ErrCartCheckedOut
+func (cg *cartGorm) Claim(id uint) error {
+	db := cg.db.Where("id = ?", id).Delete(&Cart{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrCartCheckedOut
+	}
+	return nil
+}
+func (cv *cartValidator) Claim(id uint) error {
+	var cart Cart
+	cart.ID = id
+	if err := runCartValFns(&cart, cv.idGreaterThan(0)); err != nil {
+		return err
+	}
+
+	return cv.CartDB.Claim(id)
+}
+
+// Restore will undo Claim
+func (cg *cartGorm) Restore(id uint) error {
+	return cg.db.Unscoped().Model(&Cart{}).Where("id = ?", id).UpdateColumn("deleted_at", nil).Error
+}
+func (cv *cartValidator) Restore(id uint) error {
+	var cart Cart
+	cart.ID = id
+	if err := runCartValFns(&cart, cv.idGreaterThan(0)); err != nil {
+		return err
+	}
+
+	return cv.CartDB.Restore(id)
+}
+
+// AddItem adds the product to the cart, if the product is already in the cart
+// the quantities are added together
+func (cg *cartGorm) AddItem(item *CartItem) error {
+	var existing CartItem
+	db := cg.db.Where("cart_id = ? AND product_id = ?", item.CartID, item.ProductID)
+	err := first(db, &existing)
+	switch err {
+	case ErrNotFound:
+		return cg.db.Create(item).Error
+	case nil:
+		item.ID = existing.ID
+		item.Quantity += existing.Quantity
+		return cg.UpdateItem(item)
+	default:
+		return err
+	}
+}
+func (cv *cartValidator) AddItem(item *CartItem) error {
+	err := runCartItemValFns(item,
+		cv.itemIDsGreaterThan(0),
+		cv.quantityGreaterThanZero,
+		cv.productExists)
+	if err != nil {
+		return err
+	}
+
+	return cv.CartDB.AddItem(item)
+}
+
+// UpdateItem sets the quantity of a product already in the cart
+func (cg *cartGorm) UpdateItem(item *CartItem) error {
+	return cg.db.Model(&CartItem{}).
+		Where("cart_id = ? AND product_id = ?", item.CartID, item.ProductID).
+		Update("quantity", item.Quantity).Error
+}
+func (cv *cartValidator) UpdateItem(item *CartItem) error {
+	if err := runCartItemValFns(item, cv.itemIDsGreaterThan(0)); err != nil {
+		return err
+	}
+
+	// Setting the quantity to zero is the same as removing the item
+	if item.Quantity == 0 {
+		return cv.CartDB.RemoveItem(item)
+	}
+
+	if err := runCartItemValFns(item, cv.quantityGreaterThanZero); err != nil {
+		return err
+	}
+
+	return cv.CartDB.UpdateItem(item)
+}
+
+// RemoveItem takes the product out of the cart
+func (cg *cartGorm) RemoveItem(item *CartItem) error {
+	return cg.db.Where("cart_id = ? AND product_id = ?", item.CartID, item.ProductID).
+		Delete(&CartItem{}).Error
+}
+func (cv *cartValidator) RemoveItem(item *CartItem) error {
+	if err := runCartItemValFns(item, cv.itemIDsGreaterThan(0)); err != nil {
+		return err
+	}
+
+	return cv.CartDB.RemoveItem(item)
+}
+
+// Merge moves the items of an anonymous cart into the user's cart.
+// If the user has no cart yet, the anonymous cart is simply handed over to the user.
+// A token that does not match any cart is not an error, there is just nothing to merge
+func (cs *cartService) Merge(token string, userID uint) error {
+	anonymous, err := cs.ByToken(token)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// carts that already belong to a user are never taken over
+	if anonymous.UserID != 0 {
+		return nil
+	}
+
+	existing, err := cs.ByUserID(userID)
+	switch err {
+	case ErrNotFound:
+		anonymous.UserID = userID
+		return cs.Update(anonymous)
+	case nil:
+		// merge below
+	default:
+		return err
+	}
+
+	for _, item := range anonymous.Items {
+		err := cs.AddItem(&CartItem{
+			CartID:    existing.ID,
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+		})
+		// products removed from the catalog since they were added are dropped
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+
+	return cs.Delete(anonymous.ID)
+}
+
+// runCartValFns works the same way as runUserValFns but for carts
+func runCartValFns(cart *Cart, functions ...cartValFn) error {
+	for _, fn := range functions {
+		if err := fn(cart); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCartItemValFns works the same way as runUserValFns but for cart items
+func runCartItemValFns(item *CartItem, functions ...cartItemValFn) error {
+	for _, fn := range functions {
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTokenIfUnset generates the random token used to identify the cart by cookie
+func (cv *cartValidator) setTokenIfUnset(cart *Cart) error {
+	if cart.Token != "" {
+		return nil
+	}
+	token, err := rand.String(cartTokenBytes)
+	if err != nil {
+		return err
+	}
+	cart.Token = token
+	return nil
+}
+
+// idGreaterThan will ensure a valid ID for update and delete
+func (cv *cartValidator) idGreaterThan(n uint) cartValFn {
+	return cartValFn(func(cart *Cart) error {
+		if cart.ID <= n {
+			return ErrIdInvalid
+		}
+		return nil
+	})
+}
+
+// itemIDsGreaterThan will ensure both the cart and the product IDs are valid
+func (cv *cartValidator) itemIDsGreaterThan(n uint) cartItemValFn {
+	return cartItemValFn(func(item *CartItem) error {
+		if item.CartID <= n || item.ProductID <= n {
+			return ErrIdInvalid
+		}
+		return nil
+	})
+}
+
+// quantityGreaterThanZero makes sure at least one unit is being added
+func (cv *cartValidator) quantityGreaterThanZero(item *CartItem) error {
+	if item.Quantity <= 0 {
+		return ErrQuantityInvalid
+	}
+	return nil
+}
+
+// productExists makes sure the product being added is in the catalog
+func (cv *cartValidator) productExists(item *CartItem) error {
+	_, err := cv.products.ByID(item.ProductID)
+	return err
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jinzhu/gorm"
+)
+
+// logModeKey remembers the WithLogMode setting on the gorm.DB, since the DB
+// made by openContext starts over with its own settings
+const logModeKey = "ecommerce:log_mode"
+
+// ctxDBKey is the context key of the requestDB stored by Services.WithContext
+type ctxDBKey struct{}
+
+// requestDB is a gorm.DB running its queries with ctx, made once for a request
+type requestDB struct {
+	ctx context.Context
+	db  *gorm.DB
+}
+
+// ctxDB runs the queries of a gorm.DB with a context. gorm v1 has no context
+// support of its own, so openContext opens a gorm.DB on top of one of these
+type ctxDB struct {
+	db  *sql.DB
+	ctx context.Context
+}
+
+var _ gorm.SQLCommon = ctxDB{}
+
+func (c ctxDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.db.ExecContext(c.ctx, query, args...)
+}
+
+func (c ctxDB) Prepare(query string) (*sql.Stmt, error) {
+	return c.db.PrepareContext(c.ctx, query)
+}
+
+func (c ctxDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.db.QueryContext(c.ctx, query, args...)
+}
+
+func (c ctxDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.db.QueryRowContext(c.ctx, query, args...)
+}
+
+// Begin and BeginTx let gorm start transactions, which are rolled back when ctx is done
+func (c ctxDB) Begin() (*sql.Tx, error) {
+	return c.db.BeginTx(c.ctx, nil)
+}
+
+func (c ctxDB) BeginTx(_ context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return c.db.BeginTx(c.ctx, opts)
+}
+
+// WithContext returns a copy of ctx carrying a connection that runs the queries of the
+// services with ctx, so they are cancelled once ctx is done, e.g. when the client of a
+// request goes away or its deadline passes. It is meant to be called once per request,
+// the Context methods and TransactionContext then share the connection instead of each
+// making their own. With WithMemory ctx is returned as is
+func (s *Services) WithContext(ctx context.Context) context.Context {
+	if s.db == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxDBKey{}, requestDB{ctx: ctx, db: openContext(s.db, ctx)})
+}
+
+// withContext returns a gorm.DB running its queries with ctx. It is the one stored by
+// Services.WithContext when ctx still has the same deadline and is on the same database,
+// otherwise one is made for this query only. A db in a transaction is returned as is,
+// the transaction was begun with the context it runs with, see Services.TransactionContext
+func withContext(db *gorm.DB, ctx context.Context) *gorm.DB {
+	sqlDB := sqlDBOf(db)
+	// a ctx that is never done has nothing to cancel
+	if sqlDB == nil || ctx.Done() == nil {
+		return db
+	}
+	if req, ok := ctx.Value(ctxDBKey{}).(requestDB); ok && req.ctx.Done() == ctx.Done() && sqlDBOf(req.db) == sqlDB {
+		return req.db
+	}
+	return openContext(db, ctx)
+}
+
+// sqlDBOf returns the connection pool under db, or nil when db is a transaction
+func sqlDBOf(db *gorm.DB) *sql.DB {
+	switch common := db.CommonDB().(type) {
+	case *sql.DB:
+		return common
+	case ctxDB:
+		return common.db
+	default:
+		return nil
+	}
+}
+
+// openContext opens a gorm.DB on the connection pool of db running its queries with ctx.
+// db must not be a transaction
+func openContext(db *gorm.DB, ctx context.Context) *gorm.DB {
+	ctxGorm, err := gorm.Open(db.Dialect().GetName(), ctxDB{db: sqlDBOf(db), ctx: ctx})
+	if err != nil {
+		return db
+	}
+	if logMode, ok := db.Get(logModeKey); ok {
+		ctxGorm = ctxGorm.Set(logModeKey, logMode).LogMode(logMode.(bool))
+	}
+	return ctxGorm
+}
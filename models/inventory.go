@@ -0,0 +1,359 @@
+package models
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// reservationTTL is how long stock stays held for a pending order
+// before CancelExpired cancels the order and puts the stock back on sale
+const reservationTTL = 15 * time.Minute
+
+var (
+	// ErrOutOfStock is returned when there are not enough units available to reserve
+	ErrOutOfStock modelError = "models: sorry, one or more items in your cart are out of stock"
+
+	// ErrReservationExpired is returned when stock is committed for an order
+	// whose reservations were already released
+	ErrReservationExpired modelError = "models: your reservation expired, please try again"
+
+	// ErrStockInvalid is returned when stock is set to a negative amount
+	ErrStockInvalid modelError = "models: stock cannot be negative"
+)
+
+// Stock is the inventory count of a SKU. Reserved units are held by pending
+// orders and can not be sold to anyone else
+type Stock struct {
+	gorm.Model
+	SKU      string `gorm:"not null;unique_index"`
+	OnHand   int    `gorm:"not null"`
+	Reserved int    `gorm:"not null"`
+}
+
+// Available is the number of units that can still be reserved
+func (s Stock) Available() int {
+	return s.OnHand - s.Reserved
+}
+
+// Reservation holds Quantity units of a SKU for a pending order until ExpiresAt
+type Reservation struct {
+	gorm.Model
+	OrderID   uint      `gorm:"not null;index"`
+	SKU       string    `gorm:"not null"`
+	Quantity  int       `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+type InventoryDB interface {
+	// Methods for querying stock
+	BySKU(sku string) (*Stock, error)
+	All() ([]Stock, error)
+
+	// Set creates the stock for the SKU or updates how many units are on hand
+	Set(stock *Stock) error
+
+	// Reserve holds stock for every item of the order until the reservation expires,
+	// returning ErrOutOfStock without holding anything if any item is unavailable.
+	// SKUs without stock are not tracked and can always be reserved
+	Reserve(order *Order, expiresAt time.Time) error
+
+	// Release puts the reserved stock of the order back on sale
+	Release(orderID uint) error
+
+	// Commit removes the reserved units of the order from the stock on hand
+	Commit(orderID uint) error
+
+	// Restock puts the units of a paid order back on hand once it is cancelled,
+	// its reservations were already committed
+	Restock(order *Order) error
+
+	// Expired returns the IDs of the orders holding a reservation expired before now
+	Expired(now time.Time) ([]uint, error)
+}
+
+type InventoryService interface {
+	InventoryDB
+}
+
+type inventoryService struct {
+	InventoryDB
+}
+
+type inventoryValidator struct {
+	InventoryDB
+}
+
+type inventoryGorm struct {
+	db *gorm.DB
+}
+
+var _ InventoryDB = &inventoryGorm{}
+var _ InventoryService = &inventoryService{}
+
+type stockValFn func(*Stock) error
+
+// NewInventoryService builds an InventoryService on top of the connection shared by Services
+func NewInventoryService(db *gorm.DB) InventoryService {
+	return newInventoryService(&inventoryGorm{db: db})
+}
+
+func newInventoryService(db InventoryDB) InventoryService {
+	return &inventoryService{
+		InventoryDB: &inventoryValidator{
+			InventoryDB: db,
+		},
+	}
+}
+
+// BySKU will look up the stock of the provided SKU
+// If the SKU has no stock, return ErrNotFound
+func (ig *inventoryGorm) BySKU(sku string) (*Stock, error) {
+	var stock Stock
+	err := first(ig.db.Where("sku = ?", sku), &stock)
+	if err != nil {
+		return nil, err
+	}
+	return &stock, nil
+}
+func (iv *inventoryValidator) BySKU(sku string) (*Stock, error) {
+	stock := Stock{
+		SKU: sku,
+	}
+	if err := runStockValFns(&stock, iv.normalizeSKU); err != nil {
+		return nil, err
+	}
+
+	return iv.InventoryDB.BySKU(stock.SKU)
+}
+
+// All returns the stock of every SKU ordered by SKU
+func (ig *inventoryGorm) All() ([]Stock, error) {
+	var stocks []Stock
+	err := ig.db.Order("sku").Find(&stocks).Error
+	if err != nil {
+		return nil, err
+	}
+	return stocks, nil
+}
+
+// Set only ever touches on_hand, so it can not overwrite reservations made concurrently
+func (ig *inventoryGorm) Set(stock *Stock) error {
+	existing, err := ig.BySKU(stock.SKU)
+	switch err {
+	case ErrNotFound:
+		return ig.db.Create(stock).Error
+	case nil:
+		stock.ID = existing.ID
+		return ig.db.Model(existing).UpdateColumn("on_hand", stock.OnHand).Error
+	default:
+		return err
+	}
+}
+func (iv *inventoryValidator) Set(stock *Stock) error {
+	err := runStockValFns(stock,
+		iv.normalizeSKU,
+		iv.requireSKU,
+		iv.onHandNotNegative)
+	if err != nil {
+		return err
+	}
+
+	return iv.InventoryDB.Set(stock)
+}
+
+// Reserve runs in a single transaction. Each SKU is reserved with a conditional update
+// that only matches while enough units are available, so the database row lock makes
+// two concurrent checkouts unable to oversell the last unit. SKUs are locked in
+// sorted order so concurrent reservations can not deadlock each other.
+// SKUs without stock still get a reservation, so paying the order checks it did not expire
+func (ig *inventoryGorm) Reserve(order *Order, expiresAt time.Time) error {
+	quantities := quantitiesBySKU(order)
+	skus := make([]string, 0, len(quantities))
+	for sku := range quantities {
+		skus = append(skus, sku)
+	}
+	sort.Strings(skus)
+
+	return inTransaction(ig.db, func(tx *gorm.DB) error {
+		for _, sku := range skus {
+			quantity := quantities[sku]
+			res := tx.Model(&Stock{}).
+				Where("sku = ? AND on_hand - reserved >= ?", sku, quantity).
+				UpdateColumn("reserved", gorm.Expr("reserved + ?", quantity))
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				var tracked int
+				err := tx.Model(&Stock{}).Where("sku = ?", sku).Count(&tracked).Error
+				if err != nil {
+					return err
+				}
+				if tracked > 0 {
+					return ErrOutOfStock
+				}
+			}
+
+			reservation := Reservation{
+				OrderID:   order.ID,
+				SKU:       sku,
+				Quantity:  quantity,
+				ExpiresAt: expiresAt,
+			}
+			if err := tx.Create(&reservation).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+func (iv *inventoryValidator) Reserve(order *Order, expiresAt time.Time) error {
+	if order.ID == 0 {
+		return ErrIdInvalid
+	}
+	if len(order.Items) == 0 {
+		return ErrOrderEmpty
+	}
+
+	return iv.InventoryDB.Reserve(order, expiresAt)
+}
+
+// Release gives the reserved units of the order back to the available stock
+func (ig *inventoryGorm) Release(orderID uint) error {
+	_, err := ig.settle(orderID, false)
+	return err
+}
+
+// Commit takes the reserved units of the order out of the stock on hand.
+// Returns ErrReservationExpired if the order holds no reservations anymore
+func (ig *inventoryGorm) Commit(orderID uint) error {
+	settled, err := ig.settle(orderID, true)
+	if err != nil {
+		return err
+	}
+	if settled == 0 {
+		return ErrReservationExpired
+	}
+	return nil
+}
+
+// Restock adds the quantity of every item of the order to the stock on hand of its SKU,
+// SKUs without stock are not tracked and skipped
+func (ig *inventoryGorm) Restock(order *Order) error {
+	return inTransaction(ig.db, func(tx *gorm.DB) error {
+		for sku, quantity := range quantitiesBySKU(order) {
+			err := tx.Model(&Stock{}).Where("sku = ?", sku).
+				UpdateColumn("on_hand", gorm.Expr("on_hand + ?", quantity)).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+func (iv *inventoryValidator) Restock(order *Order) error {
+	if order.ID == 0 {
+		return ErrIdInvalid
+	}
+
+	return iv.InventoryDB.Restock(order)
+}
+
+// Expired returns the IDs of the orders holding a reservation expired before now
+func (ig *inventoryGorm) Expired(now time.Time) ([]uint, error) {
+	var orderIDs []uint
+	err := ig.db.Model(&Reservation{}).
+		Where("expires_at < ?", now).
+		Pluck("DISTINCT order_id", &orderIDs).Error
+	if err != nil {
+		return nil, err
+	}
+	return orderIDs, nil
+}
+
+// settle removes the reservations of the order, in a transaction, giving the units back to the
+// available stock or, when commit is true, taking them off the stock on hand as well.
+// Each reservation is deleted before the stock is touched so that a reservation settled
+// concurrently (e.g. expired while being paid) is only ever counted once.
+// Returns how many reservations were settled
+func (ig *inventoryGorm) settle(orderID uint, commit bool) (int, error) {
+	settled := 0
+	err := inTransaction(ig.db, func(tx *gorm.DB) error {
+		var reservations []Reservation
+		err := tx.Where("order_id = ?", orderID).Order("sku").Find(&reservations).Error
+		if err != nil {
+			return err
+		}
+
+		for _, reservation := range reservations {
+			res := tx.Delete(&reservation)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				continue
+			}
+
+			updates := map[string]interface{}{
+				"reserved": gorm.Expr("reserved - ?", reservation.Quantity),
+			}
+			if commit {
+				updates["on_hand"] = gorm.Expr("on_hand - ?", reservation.Quantity)
+			}
+			err := tx.Model(&Stock{}).Where("sku = ?", reservation.SKU).UpdateColumns(updates).Error
+			if err != nil {
+				return err
+			}
+			settled++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return settled, nil
+}
+
+// quantitiesBySKU adds up the quantities of the order items sharing a SKU
+func quantitiesBySKU(order *Order) map[string]int {
+	quantities := make(map[string]int)
+	for _, item := range order.Items {
+		quantities[item.SKU] += item.Quantity
+	}
+	return quantities
+}
+
+// runStockValFns works the same way as runUserValFns but for stock
+func runStockValFns(stock *Stock, functions ...stockValFn) error {
+	for _, fn := range functions {
+		if err := fn(stock); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeSKU trims the SKU and transforms it to uppercase, the same way products do
+func (iv *inventoryValidator) normalizeSKU(stock *Stock) error {
+	stock.SKU = strings.ToUpper(strings.TrimSpace(stock.SKU))
+	return nil
+}
+
+// requireSKU makes sure a SKU has been provided
+func (iv *inventoryValidator) requireSKU(stock *Stock) error {
+	if stock.SKU == "" {
+		return ErrSKURequired
+	}
+	return nil
+}
+
+// onHandNotNegative makes sure the stock on hand is zero or more
+func (iv *inventoryValidator) onHandNotNegative(stock *Stock) error {
+	if stock.OnHand < 0 {
+		return ErrStockInvalid
+	}
+	return nil
+}
@@ -0,0 +1,661 @@
+package models
+
+import (
+	"context"
+	"ecommerce/encrypt"
+	"ecommerce/hash"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// memoryStore holds the rows of the in-memory implementations of the *DB interfaces,
+// see WithMemory. Like tables of one database every implementation sees the rows of
+// the others, so lookups across them such as ByRemember work. A single mutex guards
+// everything, it is meant for tests and local development, not for speed.
+// Rows are stored and returned as copies so callers never share them with the store,
+// and deletes are soft like with gorm, deleted rows still count for unique constraints.
+// Associations like the items of an order are kept in their own table, as in the database
+type memoryStore struct {
+	*memoryTables
+
+	// inTransaction is set on the store handed to the function run by transaction
+	inTransaction bool
+}
+
+// memoryTables are the rows of a memoryStore, shared with the stores of its transactions
+type memoryTables struct {
+	mu sync.RWMutex
+
+	// txMu makes transactions run one at a time
+	txMu sync.Mutex
+
+	lastID map[string]uint
+	memoryRows
+}
+
+// memoryRows has a map of rows by ID for every table
+type memoryRows struct {
+	users         map[uint]User
+	sessions      map[uint]Session
+	pwResets      map[uint]PasswordReset
+	recoveryCodes map[uint]RecoveryCode
+	products      map[uint]Product
+	carts         map[uint]Cart
+	cartItems     map[uint]CartItem
+	orders        map[uint]Order
+	orderItems    map[uint]OrderItem
+	stocks        map[uint]Stock
+	reservations  map[uint]Reservation
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		memoryTables: &memoryTables{
+			lastID: make(map[string]uint),
+			memoryRows: memoryRows{
+				users:         make(map[uint]User),
+				sessions:      make(map[uint]Session),
+				pwResets:      make(map[uint]PasswordReset),
+				recoveryCodes: make(map[uint]RecoveryCode),
+				products:      make(map[uint]Product),
+				carts:         make(map[uint]Cart),
+				cartItems:     make(map[uint]CartItem),
+				orders:        make(map[uint]Order),
+				orderItems:    make(map[uint]OrderItem),
+				stocks:        make(map[uint]Stock),
+				reservations:  make(map[uint]Reservation),
+			},
+		},
+	}
+}
+
+// transaction runs fn with a store whose changes are all undone when fn returns an
+// error or panics, the panic carrying on afterwards. Transactions run one at a time and
+// calling transaction on the store given to fn undoes only the changes of the inner fn.
+// Changes made outside of any transaction while one runs are lost if it is undone,
+// good enough for tests and local development
+func (ms *memoryStore) transaction(fn func(tx *memoryStore) error) error {
+	if !ms.inTransaction {
+		ms.txMu.Lock()
+		defer ms.txMu.Unlock()
+	}
+
+	ms.mu.RLock()
+	saved := ms.memoryRows.clone()
+	ms.mu.RUnlock()
+	rollback := func() {
+		ms.mu.Lock()
+		ms.memoryRows = saved
+		ms.mu.Unlock()
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			rollback()
+			panic(p)
+		}
+	}()
+
+	tx := &memoryStore{memoryTables: ms.memoryTables, inTransaction: true}
+	if err := fn(tx); err != nil {
+		rollback()
+		return err
+	}
+	return nil
+}
+
+// clone copies every table, the rows themselves are values and never changed in place.
+// IDs are not part of the rows, like a sequence they are not rolled back
+func (rows memoryRows) clone() memoryRows {
+	clone := memoryRows{
+		users:         make(map[uint]User, len(rows.users)),
+		sessions:      make(map[uint]Session, len(rows.sessions)),
+		pwResets:      make(map[uint]PasswordReset, len(rows.pwResets)),
+		recoveryCodes: make(map[uint]RecoveryCode, len(rows.recoveryCodes)),
+		products:      make(map[uint]Product, len(rows.products)),
+		carts:         make(map[uint]Cart, len(rows.carts)),
+		cartItems:     make(map[uint]CartItem, len(rows.cartItems)),
+		orders:        make(map[uint]Order, len(rows.orders)),
+		orderItems:    make(map[uint]OrderItem, len(rows.orderItems)),
+		stocks:        make(map[uint]Stock, len(rows.stocks)),
+		reservations:  make(map[uint]Reservation, len(rows.reservations)),
+	}
+	for id, row := range rows.users {
+		clone.users[id] = row
+	}
+	for id, row := range rows.sessions {
+		clone.sessions[id] = row
+	}
+	for id, row := range rows.pwResets {
+		clone.pwResets[id] = row
+	}
+	for id, row := range rows.recoveryCodes {
+		clone.recoveryCodes[id] = row
+	}
+	for id, row := range rows.products {
+		clone.products[id] = row
+	}
+	for id, row := range rows.carts {
+		clone.carts[id] = row
+	}
+	for id, row := range rows.cartItems {
+		clone.cartItems[id] = row
+	}
+	for id, row := range rows.orders {
+		clone.orders[id] = row
+	}
+	for id, row := range rows.orderItems {
+		clone.orderItems[id] = row
+	}
+	for id, row := range rows.stocks {
+		clone.stocks[id] = row
+	}
+	for id, row := range rows.reservations {
+		clone.reservations[id] = row
+	}
+	return clone
+}
+
+// create gives a new row its ID and timestamps, like a serial column and the gorm callbacks.
+// The caller must hold the write lock
+func (ms *memoryStore) create(table string, model *gorm.Model) {
+	ms.lastID[table]++
+	model.ID = ms.lastID[table]
+	now := time.Now()
+	if model.CreatedAt.IsZero() {
+		model.CreatedAt = now
+	}
+	model.UpdatedAt = now
+}
+
+// softDelete marks a row deleted the way gorm does for models with DeletedAt
+func softDelete(model *gorm.Model) {
+	now := time.Now()
+	model.DeletedAt = &now
+}
+
+// duplicateKey is returned where the database would fail on a unique index
+func duplicateKey(column string) error {
+	return fmt.Errorf("models: duplicate key value violates unique constraint on %s", column)
+}
+
+// userMemory is the in-memory UserDB
+type userMemory struct {
+	store *memoryStore
+}
+
+var _ UserDB = &userMemory{}
+
+// ByID will look up a user with the provided ID
+// If the user is not found, return ErrNotFound
+func (um *userMemory) ByID(id uint) (*User, error) {
+	return um.ByIDContext(context.Background(), id)
+}
+
+// ByIDContext is ByID failing with the error of ctx once it is done, like a cancelled query.
+// The other Context methods work the same way
+func (um *userMemory) ByIDContext(ctx context.Context, id uint) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	um.store.mu.RLock()
+	defer um.store.mu.RUnlock()
+
+	user, ok := um.store.users[id]
+	if !ok || user.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+// ByEmail looks up a user with the given email address, errors are the same as ByID
+func (um *userMemory) ByEmail(email string) (*User, error) {
+	return um.ByEmailContext(context.Background(), email)
+}
+
+func (um *userMemory) ByEmailContext(ctx context.Context, email string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	um.store.mu.RLock()
+	defer um.store.mu.RUnlock()
+
+	for _, user := range um.store.users {
+		if user.DeletedAt == nil && user.Email == email {
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// ByRemember looks up the user of an unexpired session with the given token hash
+// Errors are the same as ByID
+func (um *userMemory) ByRemember(tokenHash string) (*User, error) {
+	return um.ByRememberContext(context.Background(), tokenHash)
+}
+
+func (um *userMemory) ByRememberContext(ctx context.Context, tokenHash string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	um.store.mu.RLock()
+	defer um.store.mu.RUnlock()
+
+	now := time.Now()
+	for _, session := range um.store.sessions {
+		if session.DeletedAt != nil || session.TokenHash != tokenHash || !session.ExpiresAt.After(now) {
+			continue
+		}
+		user, ok := um.store.users[session.UserID]
+		if !ok || user.DeletedAt != nil {
+			return nil, ErrNotFound
+		}
+		return &user, nil
+	}
+	return nil, ErrNotFound
+}
+
+// All returns every user ordered by ID
+func (um *userMemory) All() ([]User, error) {
+	um.store.mu.RLock()
+	defer um.store.mu.RUnlock()
+
+	users := make([]User, 0, len(um.store.users))
+	for _, user := range um.store.users {
+		if user.DeletedAt == nil {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// Create will store the user, backfilling its ID and timestamps
+func (um *userMemory) Create(user *User) error {
+	return um.CreateContext(context.Background(), user)
+}
+
+func (um *userMemory) CreateContext(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	um.store.mu.Lock()
+	defer um.store.mu.Unlock()
+
+	if err := um.emailAvailable(user); err != nil {
+		return err
+	}
+	um.store.create("users", &user.Model)
+	um.store.users[user.ID] = *user
+	return nil
+}
+
+// Update will replace the stored user with the provided one
+// If the user is not found, return ErrNotFound
+func (um *userMemory) Update(user *User) error {
+	return um.UpdateContext(context.Background(), user)
+}
+
+func (um *userMemory) UpdateContext(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	um.store.mu.Lock()
+	defer um.store.mu.Unlock()
+
+	existing, ok := um.store.users[user.ID]
+	if !ok || existing.DeletedAt != nil {
+		return ErrNotFound
+	}
+	if err := um.emailAvailable(user); err != nil {
+		return err
+	}
+	user.CreatedAt = existing.CreatedAt
+	user.UpdatedAt = time.Now()
+	stored := *user
+	stored.TOTPLastStep = existing.TOTPLastStep
+	um.store.users[user.ID] = stored
+	return nil
+}
+
+// Delete will soft delete the user with the provided ID
+func (um *userMemory) Delete(id uint) error {
+	return um.DeleteContext(context.Background(), id)
+}
+
+func (um *userMemory) DeleteContext(ctx context.Context, id uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	um.store.mu.Lock()
+	defer um.store.mu.Unlock()
+
+	if user, ok := um.store.users[id]; ok && user.DeletedAt == nil {
+		softDelete(&user.Model)
+		um.store.users[id] = user
+	}
+	return nil
+}
+
+// UseTOTPStep records the step under the lock if the recorded one is older
+func (um *userMemory) UseTOTPStep(userID uint, step int64) (bool, error) {
+	um.store.mu.Lock()
+	defer um.store.mu.Unlock()
+
+	user, ok := um.store.users[userID]
+	if !ok || user.DeletedAt != nil || user.TOTPLastStep >= step {
+		return false, nil
+	}
+	user.TOTPLastStep = step
+	um.store.users[userID] = user
+	return true, nil
+}
+
+// IncrementFailedLogins adds one to the failed logins under the lock
+func (um *userMemory) IncrementFailedLogins(ctx context.Context, userID uint) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	um.store.mu.Lock()
+	defer um.store.mu.Unlock()
+
+	user, ok := um.store.users[userID]
+	if !ok || user.DeletedAt != nil {
+		return 0, ErrNotFound
+	}
+	user.FailedLogins++
+	um.store.users[userID] = user
+	return user.FailedLogins, nil
+}
+
+// LockUntil sets the lockout under the lock
+func (um *userMemory) LockUntil(ctx context.Context, userID uint, until time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	um.store.mu.Lock()
+	defer um.store.mu.Unlock()
+
+	if user, ok := um.store.users[userID]; ok && user.DeletedAt == nil {
+		user.LockedUntil = &until
+		um.store.users[userID] = user
+	}
+	return nil
+}
+
+// emailAvailable enforces the unique index on users.email, deleted users included.
+// The caller must hold the lock
+func (um *userMemory) emailAvailable(user *User) error {
+	for _, existing := range um.store.users {
+		if existing.ID != user.ID && existing.Email == user.Email {
+			return duplicateKey("users.email")
+		}
+	}
+	return nil
+}
+
+// sessionMemory is the in-memory SessionDB
+type sessionMemory struct {
+	store *memoryStore
+}
+
+var _ SessionDB = &sessionMemory{}
+
+// ByToken will look up an active session with the provided token hash
+// If the session is not found or expired, return ErrNotFound
+func (sm *sessionMemory) ByToken(tokenHash string) (*Session, error) {
+	sm.store.mu.RLock()
+	defer sm.store.mu.RUnlock()
+
+	now := time.Now()
+	for _, session := range sm.store.sessions {
+		if session.DeletedAt == nil && session.TokenHash == tokenHash && session.ExpiresAt.After(now) {
+			return &session, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// ByUserID returns the active sessions of the user, most recently used first
+func (sm *sessionMemory) ByUserID(userID uint) ([]Session, error) {
+	sm.store.mu.RLock()
+	defer sm.store.mu.RUnlock()
+
+	now := time.Now()
+	var sessions []Session
+	for _, session := range sm.store.sessions {
+		if session.DeletedAt == nil && session.UserID == userID && session.ExpiresAt.After(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt) })
+	return sessions, nil
+}
+
+// Create will store the session, its token hash must be unique
+func (sm *sessionMemory) Create(session *Session) error {
+	sm.store.mu.Lock()
+	defer sm.store.mu.Unlock()
+
+	for _, existing := range sm.store.sessions {
+		if existing.TokenHash == session.TokenHash {
+			return duplicateKey("sessions.token_hash")
+		}
+	}
+	sm.store.create("sessions", &session.Model)
+	stored := *session
+	stored.Token = ""
+	sm.store.sessions[session.ID] = stored
+	return nil
+}
+
+// Touch records that the session was just used, only LastSeenAt is saved
+func (sm *sessionMemory) Touch(session *Session) error {
+	sm.store.mu.Lock()
+	defer sm.store.mu.Unlock()
+
+	if existing, ok := sm.store.sessions[session.ID]; ok {
+		existing.LastSeenAt = session.LastSeenAt
+		sm.store.sessions[session.ID] = existing
+	}
+	return nil
+}
+
+// Delete will soft delete the session with the provided ID
+func (sm *sessionMemory) Delete(id uint) error {
+	sm.store.mu.Lock()
+	defer sm.store.mu.Unlock()
+
+	if session, ok := sm.store.sessions[id]; ok && session.DeletedAt == nil {
+		softDelete(&session.Model)
+		sm.store.sessions[id] = session
+	}
+	return nil
+}
+
+// DeleteByUserID soft deletes every session of the user
+func (sm *sessionMemory) DeleteByUserID(userID uint) error {
+	sm.store.mu.Lock()
+	defer sm.store.mu.Unlock()
+
+	for id, session := range sm.store.sessions {
+		if session.UserID == userID && session.DeletedAt == nil {
+			softDelete(&session.Model)
+			sm.store.sessions[id] = session
+		}
+	}
+	return nil
+}
+
+// newUserMemoryService builds a userService on the memory store, its transactions
+// build it again on the transaction of the store
+func newUserMemoryService(store *memoryStore, peppers Peppers, keyring *hash.Keyring, policy PasswordPolicy,
+	totpCipher *encrypt.AESGCM, dummyHash []byte) *userService {
+	return newUserService(&userMemory{store: store}, &pwResetMemory{store: store},
+		&sessionMemory{store: store}, &recoveryCodeMemory{store: store},
+		peppers, keyring, policy, totpCipher, dummyHash,
+		func(fn func(tx *userService) error) error {
+			return store.transaction(func(tx *memoryStore) error {
+				return fn(newUserMemoryService(tx, peppers, keyring, policy, totpCipher, dummyHash))
+			})
+		})
+}
+
+// pwResetMemory is the in-memory pwResetDB
+type pwResetMemory struct {
+	store *memoryStore
+}
+
+var _ pwResetDB = &pwResetMemory{}
+
+// ByToken will look up a reset with the provided token hash
+// If the reset is not found or expired, return ErrNotFound
+func (pwrm *pwResetMemory) ByToken(tokenHash string) (*PasswordReset, error) {
+	pwrm.store.mu.RLock()
+	defer pwrm.store.mu.RUnlock()
+
+	now := time.Now()
+	for _, pwr := range pwrm.store.pwResets {
+		if pwr.DeletedAt == nil && pwr.TokenHash == tokenHash && pwr.ExpiresAt.After(now) {
+			return &pwr, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Create will store the reset, its token hash must be unique
+func (pwrm *pwResetMemory) Create(pwr *PasswordReset) error {
+	pwrm.store.mu.Lock()
+	defer pwrm.store.mu.Unlock()
+
+	for _, existing := range pwrm.store.pwResets {
+		if existing.TokenHash == pwr.TokenHash {
+			return duplicateKey("password_resets.token_hash")
+		}
+	}
+	pwrm.store.create("password_resets", &pwr.Model)
+	stored := *pwr
+	stored.Token = ""
+	pwrm.store.pwResets[pwr.ID] = stored
+	return nil
+}
+
+// Delete will soft delete the reset with the provided ID
+// If the reset is not found or already deleted, return ErrNotFound
+func (pwrm *pwResetMemory) Delete(id uint) error {
+	pwrm.store.mu.Lock()
+	defer pwrm.store.mu.Unlock()
+
+	pwr, ok := pwrm.store.pwResets[id]
+	if !ok || pwr.DeletedAt != nil {
+		return ErrNotFound
+	}
+	softDelete(&pwr.Model)
+	pwrm.store.pwResets[id] = pwr
+	return nil
+}
+
+// DeleteByUserID will soft delete every reset of the user
+func (pwrm *pwResetMemory) DeleteByUserID(userID uint) error {
+	pwrm.store.mu.Lock()
+	defer pwrm.store.mu.Unlock()
+
+	for id, pwr := range pwrm.store.pwResets {
+		if pwr.UserID == userID && pwr.DeletedAt == nil {
+			softDelete(&pwr.Model)
+			pwrm.store.pwResets[id] = pwr
+		}
+	}
+	return nil
+}
+
+// recoveryCodeMemory is the in-memory recoveryCodeDB
+type recoveryCodeMemory struct {
+	store *memoryStore
+}
+
+var _ recoveryCodeDB = &recoveryCodeMemory{}
+
+// Replace swaps the codes of the user under the lock, so the change is atomic
+// like the transaction of recoveryCodeGorm
+func (rcm *recoveryCodeMemory) Replace(userID uint, codeHashes []string) error {
+	rcm.store.mu.Lock()
+	defer rcm.store.mu.Unlock()
+
+	// codes are deleted for good, like the Unscoped delete of recoveryCodeGorm
+	remaining := make(map[string]bool)
+	for _, rc := range rcm.store.recoveryCodes {
+		if rc.UserID != userID {
+			remaining[rc.CodeHash] = true
+		}
+	}
+	for _, codeHash := range codeHashes {
+		if remaining[codeHash] {
+			return duplicateKey("recovery_codes.code_hash")
+		}
+		remaining[codeHash] = true
+	}
+
+	for id, rc := range rcm.store.recoveryCodes {
+		if rc.UserID == userID {
+			delete(rcm.store.recoveryCodes, id)
+		}
+	}
+	for _, codeHash := range codeHashes {
+		rc := RecoveryCode{
+			UserID:   userID,
+			CodeHash: codeHash,
+		}
+		rcm.store.create("recovery_codes", &rc.Model)
+		rcm.store.recoveryCodes[rc.ID] = rc
+	}
+	return nil
+}
+
+// Use marks an unused code of the user as used
+// If there is no such code, return ErrNotFound
+func (rcm *recoveryCodeMemory) Use(userID uint, codeHash string) error {
+	rcm.store.mu.Lock()
+	defer rcm.store.mu.Unlock()
+
+	for id, rc := range rcm.store.recoveryCodes {
+		if rc.UserID == userID && rc.CodeHash == codeHash && rc.UsedAt == nil && rc.DeletedAt == nil {
+			now := time.Now()
+			rc.UsedAt = &now
+			rc.UpdatedAt = now
+			rcm.store.recoveryCodes[id] = rc
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// Remaining will count the codes of the user that were not used yet
+func (rcm *recoveryCodeMemory) Remaining(userID uint) (int, error) {
+	rcm.store.mu.RLock()
+	defer rcm.store.mu.RUnlock()
+
+	n := 0
+	for _, rc := range rcm.store.recoveryCodes {
+		if rc.UserID == userID && rc.UsedAt == nil && rc.DeletedAt == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// DeleteByUserID will delete every recovery code of the user for good
+func (rcm *recoveryCodeMemory) DeleteByUserID(userID uint) error {
+	rcm.store.mu.Lock()
+	defer rcm.store.mu.Unlock()
+
+	for id, rc := range rcm.store.recoveryCodes {
+		if rc.UserID == userID {
+			delete(rcm.store.recoveryCodes, id)
+		}
+	}
+	return nil
+}
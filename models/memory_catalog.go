@@ -0,0 +1,655 @@
+package models
+
+import (
+	"sort"
+	"time"
+)
+
+// productMemory is the in-memory ProductDB
+type productMemory struct {
+	store *memoryStore
+}
+
+var _ ProductDB = &productMemory{}
+
+// ByID will look up a product with the provided ID
+// If the product is not found, return ErrNotFound
+func (pm *productMemory) ByID(id uint) (*Product, error) {
+	pm.store.mu.RLock()
+	defer pm.store.mu.RUnlock()
+
+	product, ok := pm.store.products[id]
+	if !ok || product.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	return &product, nil
+}
+
+// BySKU will look up a product with the provided SKU
+// Errors are the same as ByID
+func (pm *productMemory) BySKU(sku string) (*Product, error) {
+	return pm.find(func(product Product) bool { return product.SKU == sku })
+}
+
+// BySlug will look up a product with the provided slug
+// Errors are the same as ByID
+func (pm *productMemory) BySlug(slug string) (*Product, error) {
+	return pm.find(func(product Product) bool { return product.Slug == slug })
+}
+
+// find returns the first product that is not deleted and matches
+func (pm *productMemory) find(match func(Product) bool) (*Product, error) {
+	pm.store.mu.RLock()
+	defer pm.store.mu.RUnlock()
+
+	for _, product := range pm.store.products {
+		if product.DeletedAt == nil && match(product) {
+			return &product, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// All returns every product in the catalog ordered by name
+func (pm *productMemory) All() ([]Product, error) {
+	pm.store.mu.RLock()
+	defer pm.store.mu.RUnlock()
+
+	products := make([]Product, 0, len(pm.store.products))
+	for _, product := range pm.store.products {
+		if product.DeletedAt == nil {
+			products = append(products, product)
+		}
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].Name < products[j].Name })
+	return products, nil
+}
+
+// Create will store the product, its SKU and slug must be unique
+func (pm *productMemory) Create(product *Product) error {
+	pm.store.mu.Lock()
+	defer pm.store.mu.Unlock()
+
+	if err := pm.unique(product); err != nil {
+		return err
+	}
+	pm.store.create("products", &product.Model)
+	pm.store.products[product.ID] = *product
+	return nil
+}
+
+// Update will replace the stored product with the provided one
+// If the product is not found, return ErrNotFound
+func (pm *productMemory) Update(product *Product) error {
+	pm.store.mu.Lock()
+	defer pm.store.mu.Unlock()
+
+	existing, ok := pm.store.products[product.ID]
+	if !ok || existing.DeletedAt != nil {
+		return ErrNotFound
+	}
+	if err := pm.unique(product); err != nil {
+		return err
+	}
+	product.CreatedAt = existing.CreatedAt
+	product.UpdatedAt = time.Now()
+	pm.store.products[product.ID] = *product
+	return nil
+}
+
+// Delete will soft delete the product with the provided ID
+func (pm *productMemory) Delete(id uint) error {
+	pm.store.mu.Lock()
+	defer pm.store.mu.Unlock()
+
+	if product, ok := pm.store.products[id]; ok && product.DeletedAt == nil {
+		softDelete(&product.Model)
+		pm.store.products[id] = product
+	}
+	return nil
+}
+
+// unique enforces the unique indexes on products.sku and products.slug.
+// The caller must hold the lock
+func (pm *productMemory) unique(product *Product) error {
+	for _, existing := range pm.store.products {
+		if existing.ID == product.ID {
+			continue
+		}
+		if existing.SKU == product.SKU {
+			return duplicateKey("products.sku")
+		}
+		if existing.Slug == product.Slug {
+			return duplicateKey("products.slug")
+		}
+	}
+	return nil
+}
+
+// cartMemory is the in-memory CartDB
+type cartMemory struct {
+	store *memoryStore
+}
+
+var _ CartDB = &cartMemory{}
+
+// ByID will look up a cart with the provided ID
+// If the cart is not found, return ErrNotFound
+func (cm *cartMemory) ByID(id uint) (*Cart, error) {
+	return cm.find(func(cart Cart) bool { return cart.ID == id })
+}
+
+// ByUserID will look up the cart belonging to the user with the provided ID
+// Errors are the same as ByID
+func (cm *cartMemory) ByUserID(userID uint) (*Cart, error) {
+	return cm.find(func(cart Cart) bool { return cart.UserID == userID })
+}
+
+// ByToken will look up the cart with the provided token
+// Errors are the same as ByID
+func (cm *cartMemory) ByToken(token string) (*Cart, error) {
+	return cm.find(func(cart Cart) bool { return cart.Token == token })
+}
+
+// find returns the cart with the lowest ID that is not deleted and matches,
+// with its items and their products loaded like cartGorm.preload
+func (cm *cartMemory) find(match func(Cart) bool) (*Cart, error) {
+	cm.store.mu.RLock()
+	defer cm.store.mu.RUnlock()
+
+	var found *Cart
+	for _, cart := range cm.store.carts {
+		if cart.DeletedAt == nil && match(cart) && (found == nil || cart.ID < found.ID) {
+			cart := cart
+			found = &cart
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+
+	found.Items = nil
+	for _, item := range cm.store.cartItems {
+		if item.DeletedAt != nil || item.CartID != found.ID {
+			continue
+		}
+		// deleted products are not preloaded by gorm either
+		item.Product = Product{}
+		if product, ok := cm.store.products[item.ProductID]; ok && product.DeletedAt == nil {
+			item.Product = product
+		}
+		found.Items = append(found.Items, item)
+	}
+	sort.Slice(found.Items, func(i, j int) bool { return found.Items[i].ID < found.Items[j].ID })
+	return found, nil
+}
+
+// Create will store the cart along with its items, its token must be unique
+func (cm *cartMemory) Create(cart *Cart) error {
+	cm.store.mu.Lock()
+	defer cm.store.mu.Unlock()
+
+	for _, existing := range cm.store.carts {
+		if existing.Token == cart.Token {
+			return duplicateKey("carts.token")
+		}
+	}
+	cm.store.create("carts", &cart.Model)
+	stored := *cart
+	stored.Items = nil
+	cm.store.carts[cart.ID] = stored
+
+	for i := range cart.Items {
+		item := &cart.Items[i]
+		item.CartID = cart.ID
+		cm.store.create("cart_items", &item.Model)
+		stored := *item
+		stored.Product = Product{}
+		cm.store.cartItems[item.ID] = stored
+	}
+	return nil
+}
+
+// Update will save the cart itself, items are changed through the item methods
+// If the cart is not found, return ErrNotFound
+func (cm *cartMemory) Update(cart *Cart) error {
+	cm.store.mu.Lock()
+	defer cm.store.mu.Unlock()
+
+	existing, ok := cm.store.carts[cart.ID]
+	if !ok || existing.DeletedAt != nil {
+		return ErrNotFound
+	}
+	for _, other := range cm.store.carts {
+		if other.ID != cart.ID && other.Token == cart.Token {
+			return duplicateKey("carts.token")
+		}
+	}
+	cart.CreatedAt = existing.CreatedAt
+	cart.UpdatedAt = time.Now()
+	stored := *cart
+	stored.Items = nil
+	cm.store.carts[cart.ID] = stored
+	return nil
+}
+
+// Delete will soft delete the cart with the provided ID along with its items
+func (cm *cartMemory) Delete(id uint) error {
+	cm.store.mu.Lock()
+	defer cm.store.mu.Unlock()
+
+	for itemID, item := range cm.store.cartItems {
+		if item.CartID == id && item.DeletedAt == nil {
+			softDelete(&item.Model)
+			cm.store.cartItems[itemID] = item
+		}
+	}
+	if cart, ok := cm.store.carts[id]; ok && cart.DeletedAt == nil {
+		softDelete(&cart.Model)
+		cm.store.carts[id] = cart
+	}
+	return nil
+}
+
+// Claim will delete the cart, keeping its items, only if it was not deleted yet.
+// If another checkout claimed it first, this will return ErrCartCheckedOut
+func (cm *cartMemory) Claim(id uint) error {
+	cm.store.mu.Lock()
+	defer cm.store.mu.Unlock()
+
+	cart, ok := cm.store.carts[id]
+	if !ok || cart.DeletedAt != nil {
+		return ErrCartCheckedOut
+	}
+	softDelete(&cart.Model)
+	cm.store.carts[id] = cart
+	return nil
+}
+
+// Restore will undo Claim
+func (cm *cartMemory) Restore(id uint) error {
+	cm.store.mu.Lock()
+	defer cm.store.mu.Unlock()
+
+	if cart, ok := cm.store.carts[id]; ok {
+		cart.DeletedAt = nil
+		cm.store.carts[id] = cart
+	}
+	return nil
+}
+
+// AddItem adds the product to the cart, if the product is already in the cart
+// the quantities are added together
+func (cm *cartMemory) AddItem(item *CartItem) error {
+	cm.store.mu.Lock()
+	defer cm.store.mu.Unlock()
+
+	for id, existing := range cm.store.cartItems {
+		if existing.DeletedAt == nil && existing.CartID == item.CartID && existing.ProductID == item.ProductID {
+			item.ID = existing.ID
+			item.Quantity += existing.Quantity
+			existing.Quantity = item.Quantity
+			existing.UpdatedAt = time.Now()
+			cm.store.cartItems[id] = existing
+			return nil
+		}
+	}
+	cm.store.create("cart_items", &item.Model)
+	stored := *item
+	stored.Product = Product{}
+	cm.store.cartItems[item.ID] = stored
+	return nil
+}
+
+// UpdateItem sets the quantity of a product already in the cart
+func (cm *cartMemory) UpdateItem(item *CartItem) error {
+	cm.store.mu.Lock()
+	defer cm.store.mu.Unlock()
+
+	for id, existing := range cm.store.cartItems {
+		if existing.DeletedAt == nil && existing.CartID == item.CartID && existing.ProductID == item.ProductID {
+			existing.Quantity = item.Quantity
+			existing.UpdatedAt = time.Now()
+			cm.store.cartItems[id] = existing
+		}
+	}
+	return nil
+}
+
+// RemoveItem takes the product out of the cart
+func (cm *cartMemory) RemoveItem(item *CartItem) error {
+	cm.store.mu.Lock()
+	defer cm.store.mu.Unlock()
+
+	for id, existing := range cm.store.cartItems {
+		if existing.DeletedAt == nil && existing.CartID == item.CartID && existing.ProductID == item.ProductID {
+			softDelete(&existing.Model)
+			cm.store.cartItems[id] = existing
+		}
+	}
+	return nil
+}
+
+// orderMemory is the in-memory OrderDB
+type orderMemory struct {
+	store *memoryStore
+}
+
+var _ OrderDB = &orderMemory{}
+
+// ByID will look up an order with the provided ID
+// If the order is not found, return ErrNotFound
+func (om *orderMemory) ByID(id uint) (*Order, error) {
+	om.store.mu.RLock()
+	defer om.store.mu.RUnlock()
+
+	order, ok := om.store.orders[id]
+	if !ok || order.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	om.loadItems(&order)
+	return &order, nil
+}
+
+// ByPaymentID will look up the order paid with the provided charge of the payment gateway
+// Errors are the same as ByID
+func (om *orderMemory) ByPaymentID(paymentID string) (*Order, error) {
+	orders, err := om.filter(func(order Order) bool { return order.PaymentID == paymentID })
+	if err != nil {
+		return nil, err
+	}
+	if len(orders) == 0 {
+		return nil, ErrNotFound
+	}
+	return &orders[len(orders)-1], nil
+}
+
+// ByUserID returns all orders placed by the user, newest first
+func (om *orderMemory) ByUserID(userID uint) ([]Order, error) {
+	return om.filter(func(order Order) bool { return order.UserID == userID })
+}
+
+// All returns every order, newest first
+func (om *orderMemory) All() ([]Order, error) {
+	return om.filter(func(order Order) bool { return true })
+}
+
+// filter returns the orders that are not deleted and match, newest first
+func (om *orderMemory) filter(match func(Order) bool) ([]Order, error) {
+	om.store.mu.RLock()
+	defer om.store.mu.RUnlock()
+
+	var orders []Order
+	for _, order := range om.store.orders {
+		if order.DeletedAt == nil && match(order) {
+			om.loadItems(&order)
+			orders = append(orders, order)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID > orders[j].ID })
+	return orders, nil
+}
+
+// loadItems sets the items of the order ordered by ID, like Preload("Items").
+// The caller must hold the lock
+func (om *orderMemory) loadItems(order *Order) {
+	order.Items = nil
+	for _, item := range om.store.orderItems {
+		if item.DeletedAt == nil && item.OrderID == order.ID {
+			order.Items = append(order.Items, item)
+		}
+	}
+	sort.Slice(order.Items, func(i, j int) bool { return order.Items[i].ID < order.Items[j].ID })
+}
+
+// Create will store the order along with its items
+func (om *orderMemory) Create(order *Order) error {
+	om.store.mu.Lock()
+	defer om.store.mu.Unlock()
+
+	om.store.create("orders", &order.Model)
+	stored := *order
+	stored.Items = nil
+	om.store.orders[order.ID] = stored
+
+	for i := range order.Items {
+		item := &order.Items[i]
+		item.OrderID = order.ID
+		om.store.create("order_items", &item.Model)
+		om.store.orderItems[item.ID] = *item
+	}
+	return nil
+}
+
+// Update will save the order itself, items are never changed once the order is placed
+// If the order is not found, return ErrNotFound
+func (om *orderMemory) Update(order *Order) error {
+	om.store.mu.Lock()
+	defer om.store.mu.Unlock()
+
+	existing, ok := om.store.orders[order.ID]
+	if !ok || existing.DeletedAt != nil {
+		return ErrNotFound
+	}
+	order.CreatedAt = existing.CreatedAt
+	order.UpdatedAt = time.Now()
+	stored := *order
+	stored.Items = nil
+	om.store.orders[order.ID] = stored
+	return nil
+}
+
+// UpdateStatus will save the status and payment ID of the order if its stored
+// status is still from. If it is not, ErrOrderChanged is returned
+func (om *orderMemory) UpdateStatus(order *Order, from string) error {
+	om.store.mu.Lock()
+	defer om.store.mu.Unlock()
+
+	existing, ok := om.store.orders[order.ID]
+	if !ok || existing.DeletedAt != nil || existing.Status != from {
+		return ErrOrderChanged
+	}
+	existing.Status = order.Status
+	existing.PaymentID = order.PaymentID
+	existing.UpdatedAt = time.Now()
+	om.store.orders[order.ID] = existing
+	return nil
+}
+
+// Delete will soft delete the order with the provided ID
+func (om *orderMemory) Delete(id uint) error {
+	om.store.mu.Lock()
+	defer om.store.mu.Unlock()
+
+	if order, ok := om.store.orders[id]; ok && order.DeletedAt == nil {
+		softDelete(&order.Model)
+		om.store.orders[id] = order
+	}
+	return nil
+}
+
+// newOrderMemoryService is the OrderService of WithMemory, its transactions are
+// the ones of the store
+func newOrderMemoryService(store *memoryStore) *orderService {
+	return newOrderService(&orderMemory{store: store}, &inventoryMemory{store: store},
+		func(fn func(tx *orderService) error) error {
+			return store.transaction(func(tx *memoryStore) error {
+				return fn(newOrderMemoryService(tx))
+			})
+		})
+}
+
+// inventoryMemory is the in-memory InventoryDB
+type inventoryMemory struct {
+	store *memoryStore
+}
+
+var _ InventoryDB = &inventoryMemory{}
+
+// BySKU will look up the stock of the provided SKU
+// If the SKU has no stock, return ErrNotFound
+func (im *inventoryMemory) BySKU(sku string) (*Stock, error) {
+	im.store.mu.RLock()
+	defer im.store.mu.RUnlock()
+
+	if id, ok := im.stockID(sku); ok {
+		stock := im.store.stocks[id]
+		return &stock, nil
+	}
+	return nil, ErrNotFound
+}
+
+// stockID returns the ID of the stock of the SKU, the caller must hold the lock
+func (im *inventoryMemory) stockID(sku string) (uint, bool) {
+	for id, stock := range im.store.stocks {
+		if stock.DeletedAt == nil && stock.SKU == sku {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// All returns the stock of every SKU ordered by SKU
+func (im *inventoryMemory) All() ([]Stock, error) {
+	im.store.mu.RLock()
+	defer im.store.mu.RUnlock()
+
+	stocks := make([]Stock, 0, len(im.store.stocks))
+	for _, stock := range im.store.stocks {
+		if stock.DeletedAt == nil {
+			stocks = append(stocks, stock)
+		}
+	}
+	sort.Slice(stocks, func(i, j int) bool { return stocks[i].SKU < stocks[j].SKU })
+	return stocks, nil
+}
+
+// Set creates the stock of the SKU or updates how many units are on hand
+func (im *inventoryMemory) Set(stock *Stock) error {
+	im.store.mu.Lock()
+	defer im.store.mu.Unlock()
+
+	id, ok := im.stockID(stock.SKU)
+	if !ok {
+		im.store.create("stocks", &stock.Model)
+		im.store.stocks[stock.ID] = *stock
+		return nil
+	}
+	existing := im.store.stocks[id]
+	existing.OnHand = stock.OnHand
+	existing.UpdatedAt = time.Now()
+	im.store.stocks[id] = existing
+	stock.ID = id
+	return nil
+}
+
+// Reserve checks every SKU before holding anything, under the lock, so it either
+// reserves all the items of the order or none. SKUs without stock are not tracked
+// but still get a reservation, like inventoryGorm.Reserve
+func (im *inventoryMemory) Reserve(order *Order, expiresAt time.Time) error {
+	im.store.mu.Lock()
+	defer im.store.mu.Unlock()
+
+	quantities := quantitiesBySKU(order)
+	for sku, quantity := range quantities {
+		if id, ok := im.stockID(sku); ok && im.store.stocks[id].Available() < quantity {
+			return ErrOutOfStock
+		}
+	}
+
+	for sku, quantity := range quantities {
+		if id, ok := im.stockID(sku); ok {
+			stock := im.store.stocks[id]
+			stock.Reserved += quantity
+			im.store.stocks[id] = stock
+		}
+		reservation := Reservation{
+			OrderID:   order.ID,
+			SKU:       sku,
+			Quantity:  quantity,
+			ExpiresAt: expiresAt,
+		}
+		im.store.create("reservations", &reservation.Model)
+		im.store.reservations[reservation.ID] = reservation
+	}
+	return nil
+}
+
+// Release gives the reserved units of the order back to the available stock
+func (im *inventoryMemory) Release(orderID uint) error {
+	im.store.mu.Lock()
+	defer im.store.mu.Unlock()
+
+	im.settle(orderID, false)
+	return nil
+}
+
+// Commit takes the reserved units of the order out of the stock on hand.
+// Returns ErrReservationExpired if the order holds no reservations anymore
+func (im *inventoryMemory) Commit(orderID uint) error {
+	im.store.mu.Lock()
+	defer im.store.mu.Unlock()
+
+	if im.settle(orderID, true) == 0 {
+		return ErrReservationExpired
+	}
+	return nil
+}
+
+// Restock adds the quantity of every item of the order to the stock on hand of its SKU,
+// SKUs without stock are not tracked and skipped
+func (im *inventoryMemory) Restock(order *Order) error {
+	im.store.mu.Lock()
+	defer im.store.mu.Unlock()
+
+	for sku, quantity := range quantitiesBySKU(order) {
+		if id, ok := im.stockID(sku); ok {
+			stock := im.store.stocks[id]
+			stock.OnHand += quantity
+			im.store.stocks[id] = stock
+		}
+	}
+	return nil
+}
+
+// Expired returns the IDs of the orders holding a reservation expired before now
+func (im *inventoryMemory) Expired(now time.Time) ([]uint, error) {
+	im.store.mu.RLock()
+	defer im.store.mu.RUnlock()
+
+	seen := make(map[uint]bool)
+	var orderIDs []uint
+	for _, reservation := range im.store.reservations {
+		if reservation.DeletedAt == nil && reservation.ExpiresAt.Before(now) && !seen[reservation.OrderID] {
+			seen[reservation.OrderID] = true
+			orderIDs = append(orderIDs, reservation.OrderID)
+		}
+	}
+	sort.Slice(orderIDs, func(i, j int) bool { return orderIDs[i] < orderIDs[j] })
+	return orderIDs, nil
+}
+
+// settle soft deletes the reservations of the order, giving the units back to the
+// available stock or, when commit is true, taking them off the stock on hand as well.
+// Returns how many reservations were settled, the caller must hold the lock
+func (im *inventoryMemory) settle(orderID uint, commit bool) int {
+	settled := 0
+	for id, reservation := range im.store.reservations {
+		if reservation.DeletedAt != nil || reservation.OrderID != orderID {
+			continue
+		}
+		softDelete(&reservation.Model)
+		im.store.reservations[id] = reservation
+
+		if stockID, ok := im.stockID(reservation.SKU); ok {
+			stock := im.store.stocks[stockID]
+			stock.Reserved -= reservation.Quantity
+			if commit {
+				stock.OnHand -= reservation.Quantity
+			}
+			im.store.stocks[stockID] = stock
+		}
+		settled++
+	}
+	return settled
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+// createUser creates a user with the email and a valid password
+func createUser(t *testing.T, s *Services, email string) *User {
+	t.Helper()
+
+	user := User{
+		Name:     "Jon Calhoun",
+		Email:    email,
+		Password: "correct horse battery",
+	}
+	if err := s.User.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	return &user
+}
+
+func TestMemoryNotFound(t *testing.T) {
+	s := newMemoryServices(t)
+	deleted := createUser(t, s, "deleted@example.com")
+	if err := s.User.Delete(deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		lookup func() error
+	}{
+		{"user by ID", func() error { _, err := s.User.ByID(42); return err }},
+		{"deleted user by ID", func() error { _, err := s.User.ByID(deleted.ID); return err }},
+		{"user by email", func() error { _, err := s.User.ByEmail("nobody@example.com"); return err }},
+		{"deleted user by email", func() error { _, err := s.User.ByEmail("deleted@example.com"); return err }},
+		{"user by remember token", func() error { _, err := s.User.ByRemember("unknown-token"); return err }},
+		{"user by empty remember token", func() error { _, err := s.User.ByRemember(""); return err }},
+		{"session by token", func() error { _, err := s.Session.ByToken("unknown-token"); return err }},
+		{"product by ID", func() error { _, err := s.Product.ByID(42); return err }},
+		{"product by SKU", func() error { _, err := s.Product.BySKU("NOPE-1"); return err }},
+		{"product by slug", func() error { _, err := s.Product.BySlug("nope"); return err }},
+		{"cart by ID", func() error { _, err := s.Cart.ByID(42); return err }},
+		{"cart by user ID", func() error { _, err := s.Cart.ByUserID(42); return err }},
+		{"cart by token", func() error { _, err := s.Cart.ByToken("unknown-token"); return err }},
+		{"order by ID", func() error { _, err := s.Order.ByID(42); return err }},
+		{"stock by SKU", func() error { _, err := s.Inventory.BySKU("NOPE-1"); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.lookup(); err != ErrNotFound {
+				t.Errorf("got error %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestMemoryDuplicateEmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		email   string
+		deleted bool
+		want    error
+	}{
+		{"same email", "jon@example.com", false, ErrEmailTaken},
+		{"different case", "JON@Example.COM", false, ErrEmailTaken},
+		{"surrounding spaces", "  jon@example.com ", false, ErrEmailTaken},
+		{"other email", "jane@example.com", false, nil},
+		{"email of a deleted user", "jon@example.com", true, duplicateKey("users.email")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMemoryServices(t)
+			existing := createUser(t, s, "jon@example.com")
+			if tt.deleted {
+				if err := s.User.Delete(existing.ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			user := User{
+				Name:     "Someone Else",
+				Email:    tt.email,
+				Password: "another good password",
+			}
+			err := s.User.Create(&user)
+			if tt.want == nil && err != nil {
+				t.Fatalf("got error %v, want none", err)
+			}
+			if tt.want != nil && (err == nil || err.Error() != tt.want.Error()) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryTokenHashUnique(t *testing.T) {
+	store := newMemoryStore()
+	sessions := &sessionMemory{store: store}
+	resets := &pwResetMemory{store: store}
+
+	tests := []struct {
+		name   string
+		create func(tokenHash string) error
+		column string
+	}{
+		{"session", func(tokenHash string) error {
+			return sessions.Create(&Session{UserID: 1, TokenHash: tokenHash})
+		}, "sessions.token_hash"},
+		{"password reset", func(tokenHash string) error {
+			return resets.Create(&PasswordReset{UserID: 1, TokenHash: tokenHash})
+		}, "password_resets.token_hash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.create("hash-1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.create("hash-2"); err != nil {
+				t.Fatalf("got error %v for another token hash, want none", err)
+			}
+			want := duplicateKey(tt.column)
+			if err := tt.create("hash-1"); err == nil || err.Error() != want.Error() {
+				t.Fatalf("got error %v for the same token hash, want %v", err, want)
+			}
+		})
+	}
+}
+
+func TestMemoryTransaction(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name     string
+		err      error
+		products int
+	}{
+		{"committed", nil, 1},
+		{"rolled back", errFailed, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMemoryServices(t)
+			err := s.Transaction(func(tx *Services) error {
+				product := Product{Name: "Blue T-Shirt", SKU: "TS-1", Price: 1500}
+				if err := tx.Product.Create(&product); err != nil {
+					return err
+				}
+				return tt.err
+			})
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+
+			products, err := s.Product.All()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(products) != tt.products {
+				t.Fatalf("got %d products, want %d", len(products), tt.products)
+			}
+		})
+	}
+}
@@ -0,0 +1,498 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Order statuses, see orderTransitions for the allowed moves between them
+const (
+	OrderPending   = "pending"
+	OrderPaid      = "paid"
+	OrderFulfilled = "fulfilled"
+	OrderShipped   = "shipped"
+	OrderDelivered = "delivered"
+	OrderCancelled = "cancelled"
+	OrderRefunded  = "refunded"
+)
+
+// orderTransitions is the order lifecycle state machine, mapping each status
+// to the statuses an order is allowed to move to next
+var orderTransitions = map[string][]string{
+	OrderPending:   {OrderPaid, OrderCancelled},
+	OrderPaid:      {OrderFulfilled, OrderCancelled, OrderRefunded},
+	OrderFulfilled: {OrderShipped, OrderRefunded},
+	OrderShipped:   {OrderDelivered, OrderRefunded},
+	OrderDelivered: {OrderRefunded},
+	OrderCancelled: {},
+	OrderRefunded:  {},
+}
+
+var (
+	// ErrOrderEmpty is returned when an order is placed without any items
+	ErrOrderEmpty modelError = "models: order must contain at least one item"
+
+	// ErrUserIDRequired is returned when an order is created without the user placing it
+	ErrUserIDRequired modelError = "models: user ID is required"
+
+	// ErrStatusInvalid is returned when an order is saved with an unknown status
+	ErrStatusInvalid modelError = "models: order status is not valid"
+
+	// ErrTransitionInvalid is returned when an order is moved to a status
+	// not allowed by orderTransitions, e.g. from delivered back to pending
+	ErrTransitionInvalid modelError = "models: order cannot move to that status"
+
+	// ErrOrderChanged is returned when the status of an order was changed by
+	// someone else between reading the order and updating it
+	ErrOrderChanged modelError = "models: order was changed in the meantime, please try again"
+)
+
+// Order is placed by a user and keeps a snapshot of the products bought,
+// so later catalog changes do not alter past orders. Total is in cents
+type Order struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Status    string `gorm:"not null;index"`
+	Total     int    `gorm:"not null"`
+	PaymentID string `gorm:"index"`
+	Items     []OrderItem
+}
+
+// OrderItem is a line of an order, with the product name and price copied at the time of purchase
+type OrderItem struct {
+	gorm.Model
+	OrderID   uint   `gorm:"not null;index"`
+	ProductID uint   `gorm:"not null"`
+	Name      string `gorm:"not null"`
+	SKU       string `gorm:"not null"`
+	Price     int    `gorm:"not null"`
+	Quantity  int    `gorm:"not null"`
+}
+
+// Subtotal is the item price multiplied by the quantity, in cents
+func (oi OrderItem) Subtotal() int {
+	return oi.Price * oi.Quantity
+}
+
+// CanMoveTo reports whether the order is allowed to move to the provided status
+func (o Order) CanMoveTo(status string) bool {
+	for _, next := range orderTransitions[o.Status] {
+		if next == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Next lists the statuses the order is allowed to move to
+func (o Order) Next() []string {
+	return orderTransitions[o.Status]
+}
+
+type OrderDB interface {
+	// Methods for querying orders, items are preloaded
+	ByID(id uint) (*Order, error)
+	ByPaymentID(paymentID string) (*Order, error)
+	ByUserID(userID uint) ([]Order, error)
+	All() ([]Order, error)
+
+	// Methods for altering orders
+	Create(order *Order) error
+	Update(order *Order) error
+	Delete(id uint) error
+
+	// UpdateStatus saves the status and payment ID of the order, but only
+	// while the stored order still has the status from
+	UpdateStatus(order *Order, from string) error
+}
+
+type OrderService interface {
+	// Place creates a pending order from the items in the cart and reserves their stock.
+	// The cart itself is left untouched
+	Place(cart *Cart) (*Order, error)
+
+	// Transition moves the order to the provided status, following orderTransitions.
+	// Paying an order commits its reserved stock and cancelling it releases the stock
+	Transition(order *Order, status string) error
+
+	// CancelExpired cancels every pending order whose stock reservation expired
+	// before now, returning how many orders were cancelled
+	CancelExpired(now time.Time) (int, error)
+	OrderDB
+}
+
+type orderService struct {
+	OrderDB
+	inventory InventoryDB
+
+	// transaction runs fn with an orderService whose queries share one transaction
+	transaction func(fn func(tx *orderService) error) error
+}
+
+type orderValidator struct {
+	OrderDB
+}
+
+type orderGorm struct {
+	db *gorm.DB
+}
+
+var _ OrderDB = &orderGorm{}
+var _ OrderService = &orderService{}
+
+type orderValFn func(*Order) error
+
+// NewOrderService builds an OrderService on top of the connection shared by Services
+func NewOrderService(db *gorm.DB) OrderService {
+	return newOrderGormService(db)
+}
+
+func newOrderGormService(db *gorm.DB) *orderService {
+	return newOrderService(&orderGorm{db: db}, &inventoryGorm{db: db},
+		func(fn func(tx *orderService) error) error {
+			return inTransaction(db, func(tx *gorm.DB) error {
+				return fn(newOrderGormService(tx))
+			})
+		})
+}
+
+func newOrderService(db OrderDB, inventory InventoryDB, transaction func(fn func(tx *orderService) error) error) *orderService {
+	return &orderService{
+		OrderDB: &orderValidator{
+			OrderDB: db,
+		},
+		inventory: &inventoryValidator{
+			InventoryDB: inventory,
+		},
+		transaction: transaction,
+	}
+}
+
+// ByID will look up an order with the provided ID
+// If the order is not found, return ErrNotFound
+func (og *orderGorm) ByID(id uint) (*Order, error) {
+	var order Order
+	err := first(og.db.Preload("Items").Where("id = ?", id), &order)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// ByPaymentID will look up the order paid with the provided charge of the payment gateway
+// Errors are the same as ByID
+func (og *orderGorm) ByPaymentID(paymentID string) (*Order, error) {
+	var order Order
+	err := first(og.db.Preload("Items").Where("payment_id = ?", paymentID), &order)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+func (ov *orderValidator) ByPaymentID(paymentID string) (*Order, error) {
+	if paymentID == "" {
+		return nil, ErrNotFound
+	}
+	return ov.OrderDB.ByPaymentID(paymentID)
+}
+
+// ByUserID returns all orders placed by the user, newest first
+func (og *orderGorm) ByUserID(userID uint) ([]Order, error) {
+	var orders []Order
+	err := og.db.Preload("Items").
+		Where("user_id = ?", userID).
+		Order("id desc").
+		Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// All returns every order, newest first
+func (og *orderGorm) All() ([]Order, error) {
+	var orders []Order
+	err := og.db.Preload("Items").Order("id desc").Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// Create will create the order along with its items
+func (og *orderGorm) Create(order *Order) error {
+	return og.db.Create(order).Error
+}
+func (ov *orderValidator) Create(order *Order) error {
+	err := runOrderValFns(order,
+		ov.userIDRequired,
+		ov.itemsRequired,
+		ov.quantitiesGreaterThanZero,
+		ov.setStatusPending,
+		ov.calculateTotal)
+	if err != nil {
+		return err
+	}
+
+	return ov.OrderDB.Create(order)
+}
+
+// Update will save the order itself, items are never changed once the order is placed
+func (og *orderGorm) Update(order *Order) error {
+	return og.db.Set("gorm:save_associations", false).Save(order).Error
+}
+func (ov *orderValidator) Update(order *Order) error {
+	err := runOrderValFns(order,
+		ov.idGreaterThan(0),
+		ov.statusValid,
+		ov.transitionAllowed)
+	if err != nil {
+		return err
+	}
+
+	return ov.OrderDB.Update(order)
+}
+
+// UpdateStatus will save the status and payment ID of the order if its stored
+// status is still from. If it is not, ErrOrderChanged is returned
+func (og *orderGorm) UpdateStatus(order *Order, from string) error {
+	res := og.db.Model(&Order{}).
+		Where("id = ? AND status = ?", order.ID, from).
+		Updates(map[string]interface{}{
+			"status":     order.Status,
+			"payment_id": order.PaymentID,
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrOrderChanged
+	}
+	return nil
+}
+func (ov *orderValidator) UpdateStatus(order *Order, from string) error {
+	err := runOrderValFns(order,
+		ov.idGreaterThan(0),
+		ov.statusValid,
+		ov.transitionFrom(from))
+	if err != nil {
+		return err
+	}
+
+	return ov.OrderDB.UpdateStatus(order, from)
+}
+
+// Delete will delete the order with the provided ID
+func (og *orderGorm) Delete(id uint) error {
+	order := Order{Model: gorm.Model{ID: id}}
+	return og.db.Delete(&order).Error
+}
+func (ov *orderValidator) Delete(id uint) error {
+	var order Order
+	order.ID = id
+	if err := runOrderValFns(&order, ov.idGreaterThan(0)); err != nil {
+		return err
+	}
+
+	return ov.OrderDB.Delete(id)
+}
+
+// Place snapshots every cart item into a new pending order for the cart's user
+// and reserves the stock for it. If the stock can not be reserved the order is
+// cancelled and ErrOutOfStock is returned
+func (ors *orderService) Place(cart *Cart) (*Order, error) {
+	order := Order{
+		UserID: cart.UserID,
+	}
+	for _, item := range cart.Items {
+		order.Items = append(order.Items, OrderItem{
+			ProductID: item.ProductID,
+			Name:      item.Product.Name,
+			SKU:       item.Product.SKU,
+			Price:     item.Product.Price,
+			Quantity:  item.Quantity,
+		})
+	}
+
+	if err := ors.Create(&order); err != nil {
+		return nil, err
+	}
+
+	err := ors.inventory.Reserve(&order, time.Now().Add(reservationTTL))
+	if err != nil {
+		order.Status = OrderCancelled
+		ors.Update(&order)
+		return nil, err
+	}
+
+	return &order, nil
+}
+
+// Transition moves the order to the provided status, the validators
+// reject any move not allowed by orderTransitions. The stored order must still
+// have the status of the provided one, otherwise ErrOrderChanged is returned.
+// Reserved stock is committed before an order is marked paid, so an order whose
+// reservation expired can not be paid, and released once an order is cancelled.
+// Cancelling a paid order puts its committed units back on hand.
+// The stock and the order are changed in one transaction
+func (ors *orderService) Transition(order *Order, status string) error {
+	previous := order.Status
+	err := ors.transaction(func(tx *orderService) error {
+		if status == OrderPaid && order.CanMoveTo(OrderPaid) {
+			if err := tx.inventory.Commit(order.ID); err != nil {
+				return err
+			}
+		}
+
+		order.Status = status
+		if err := tx.UpdateStatus(order, previous); err != nil {
+			return err
+		}
+
+		if status == OrderCancelled && previous == OrderPaid {
+			return tx.inventory.Restock(order)
+		}
+		if status == OrderCancelled {
+			return tx.inventory.Release(order.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		order.Status = previous
+	}
+	return err
+}
+
+// CancelExpired cancels the orders holding an expired reservation with Transition,
+// each in its own transaction. An order paid or cancelled in the meantime is skipped,
+// the reservations of an order that is not pending anymore are only released
+func (ors *orderService) CancelExpired(now time.Time) (int, error) {
+	orderIDs, err := ors.inventory.Expired(now)
+	if err != nil {
+		return 0, err
+	}
+
+	cancelled := 0
+	for _, orderID := range orderIDs {
+		pending := false
+		err := ors.transaction(func(tx *orderService) error {
+			order, err := tx.ByID(orderID)
+			if err != nil {
+				return err
+			}
+			if order.Status != OrderPending {
+				return tx.inventory.Release(order.ID)
+			}
+			pending = true
+			return tx.Transition(order, OrderCancelled)
+		})
+		switch {
+		case err == ErrOrderChanged:
+		case err != nil:
+			return cancelled, err
+		case pending:
+			cancelled++
+		}
+	}
+	return cancelled, nil
+}
+
+// runOrderValFns works the same way as runUserValFns but for orders
+func runOrderValFns(order *Order, functions ...orderValFn) error {
+	for _, fn := range functions {
+		if err := fn(order); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userIDRequired makes sure the order belongs to a user
+func (ov *orderValidator) userIDRequired(order *Order) error {
+	if order.UserID == 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+// itemsRequired makes sure the order is not empty
+func (ov *orderValidator) itemsRequired(order *Order) error {
+	if len(order.Items) == 0 {
+		return ErrOrderEmpty
+	}
+	return nil
+}
+
+// quantitiesGreaterThanZero makes sure every item has at least one unit
+func (ov *orderValidator) quantitiesGreaterThanZero(order *Order) error {
+	for _, item := range order.Items {
+		if item.Quantity <= 0 {
+			return ErrQuantityInvalid
+		}
+	}
+	return nil
+}
+
+// setStatusPending makes sure every new order starts its lifecycle as pending
+func (ov *orderValidator) setStatusPending(order *Order) error {
+	order.Status = OrderPending
+	return nil
+}
+
+// calculateTotal sums the item subtotals so the total can never disagree with the items
+func (ov *orderValidator) calculateTotal(order *Order) error {
+	order.Total = 0
+	for _, item := range order.Items {
+		order.Total += item.Subtotal()
+	}
+	return nil
+}
+
+// statusValid makes sure the status is one of the known order statuses
+func (ov *orderValidator) statusValid(order *Order) error {
+	if _, ok := orderTransitions[order.Status]; !ok {
+		return ErrStatusInvalid
+	}
+	return nil
+}
+
+// transitionAllowed looks up the stored order and makes sure moving from its status
+// to the new one is allowed. Saving an order without changing its status is always allowed
+func (ov *orderValidator) transitionAllowed(order *Order) error {
+	existing, err := ov.ByID(order.ID)
+	if err != nil {
+		return err
+	}
+
+	if existing.Status == order.Status {
+		return nil
+	}
+
+	if !existing.CanMoveTo(order.Status) {
+		return ErrTransitionInvalid
+	}
+	return nil
+}
+
+// transitionFrom makes sure moving from the provided status to the order's one
+// is allowed by orderTransitions
+func (ov *orderValidator) transitionFrom(from string) orderValFn {
+	return orderValFn(func(order *Order) error {
+		previous := Order{Status: from}
+		if !previous.CanMoveTo(order.Status) {
+			return ErrTransitionInvalid
+		}
+		return nil
+	})
+}
+
+// idGreaterThan will ensure a valid ID for update and delete
+func (ov *orderValidator) idGreaterThan(n uint) orderValFn {
+	return orderValFn(func(order *Order) error {
+		if order.ID <= n {
+			return ErrIdInvalid
+		}
+		return nil
+	})
+}
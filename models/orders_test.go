@@ -0,0 +1,125 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+// placeOrder places a pending order for two of a product with five units in stock
+func placeOrder(t *testing.T, s *Services) *Order {
+	t.Helper()
+
+	product := Product{Name: "Blue T-Shirt", SKU: "TS-1", Price: 1500}
+	if err := s.Product.Create(&product); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Inventory.Set(&Stock{SKU: "TS-1", OnHand: 5}); err != nil {
+		t.Fatal(err)
+	}
+	cart := Cart{
+		UserID: 1,
+		Items:  []CartItem{{ProductID: product.ID, Product: product, Quantity: 2}},
+	}
+	order, err := s.Order.Place(&cart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+// checkStock fails the test unless the stock of TS-1 matches
+func checkStock(t *testing.T, s *Services, onHand, reserved int) {
+	t.Helper()
+
+	stock, err := s.Inventory.BySKU("TS-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stock.OnHand != onHand || stock.Reserved != reserved {
+		t.Fatalf("got %d on hand and %d reserved, want %d and %d", stock.OnHand, stock.Reserved, onHand, reserved)
+	}
+}
+
+// checkStatus fails the test unless the stored order has the status
+func checkStatus(t *testing.T, s *Services, orderID uint, status string) {
+	t.Helper()
+
+	order, err := s.Order.ByID(orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != status {
+		t.Fatalf("got order status %q, want %q", order.Status, status)
+	}
+}
+
+func TestCancelExpired(t *testing.T) {
+	expired := time.Now().Add(reservationTTL + time.Minute)
+
+	tests := []struct {
+		name      string
+		pay       bool
+		cancelled int
+		status    string
+		onHand    int
+	}{
+		{"pending order", false, 1, OrderCancelled, 5},
+		{"paid order", true, 0, OrderPaid, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eachStorage(t, func(t *testing.T, s *Services) {
+				order := placeOrder(t, s)
+				if tt.pay {
+					if err := s.Order.Transition(order, OrderPaid); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				n, err := s.Order.CancelExpired(expired)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != tt.cancelled {
+					t.Fatalf("got %d orders cancelled, want %d", n, tt.cancelled)
+				}
+				checkStatus(t, s, order.ID, tt.status)
+				checkStock(t, s, tt.onHand, 0)
+
+				if n, err := s.Order.CancelExpired(expired); err != nil || n != 0 {
+					t.Fatalf("got %d orders cancelled and error %v the second time, want none", n, err)
+				}
+			})
+		})
+	}
+}
+
+func TestCancelRestoresStock(t *testing.T) {
+	tests := []struct {
+		name string
+		pay  bool
+	}{
+		{"pending order", false},
+		{"paid order", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eachStorage(t, func(t *testing.T, s *Services) {
+				order := placeOrder(t, s)
+				checkStock(t, s, 5, 2)
+				if tt.pay {
+					if err := s.Order.Transition(order, OrderPaid); err != nil {
+						t.Fatal(err)
+					}
+					checkStock(t, s, 3, 0)
+				}
+
+				if err := s.Order.Transition(order, OrderCancelled); err != nil {
+					t.Fatal(err)
+				}
+				checkStatus(t, s, order.ID, OrderCancelled)
+				checkStock(t, s, 5, 0)
+			})
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrPasswordTooLong is returned when a password is longer than the policy allows
+	ErrPasswordTooLong modelError = "models: password is too long"
+
+	// ErrPasswordBreached is returned when a password is on the breached password list
+	ErrPasswordBreached modelError = "models: this password has appeared in a data breach, please choose another one"
+
+	// ErrPasswordIsEmail is returned when the password is the user's email address
+	ErrPasswordIsEmail modelError = "models: password cannot be your email address"
+)
+
+// PasswordPolicy decides which passwords users can choose and how they are hashed.
+// bcrypt ignores anything past 72 bytes, pepper included, so MaxLength plus the
+// length of the pepper must not exceed it
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+
+	// Breached holds lowercased passwords known from data breaches, see LoadBreachedPasswords
+	Breached map[string]struct{}
+
+	// DisallowEmail refuses passwords equal to the user's email address
+	DisallowEmail bool
+
+	// Cost is the bcrypt cost of new hashes, older hashes are upgraded on login
+	Cost int
+}
+
+// DefaultPasswordPolicy is the policy used when none is configured
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:     passwordMinLength,
+		MaxLength:     56,
+		DisallowEmail: true,
+		Cost:          bcrypt.DefaultCost,
+	}
+}
+
+// LoadBreachedPasswords reads a breached password list with one password per line.
+// Empty lines and lines starting with # are skipped
+func LoadBreachedPasswords(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	breached := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		breached[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return breached, nil
+}
+
+// passwordMaxLength makes sure the password is not longer than the policy allows
+func (uv *userValidator) passwordMaxLength(user *User) error {
+	if user.Password == "" || uv.policy.MaxLength == 0 {
+		return nil
+	}
+	if len(user.Password) > uv.policy.MaxLength {
+		return ErrPasswordTooLong
+	}
+	return nil
+}
+
+// passwordNotBreached makes sure the password is not on the breached password list
+func (uv *userValidator) passwordNotBreached(user *User) error {
+	if user.Password == "" {
+		return nil
+	}
+	if _, ok := uv.policy.Breached[strings.ToLower(user.Password)]; ok {
+		return ErrPasswordBreached
+	}
+	return nil
+}
+
+// passwordNotEmail makes sure the password is not the user's email address
+func (uv *userValidator) passwordNotEmail(user *User) error {
+	if user.Password == "" || !uv.policy.DisallowEmail {
+		return nil
+	}
+	email := strings.ToLower(strings.TrimSpace(user.Email))
+	if email != "" && strings.ToLower(user.Password) == email {
+		return ErrPasswordIsEmail
+	}
+	return nil
+}
+
+// needsRehash reports whether the password hash of the user was made with an
+// outdated bcrypt cost or pepper
+func (uv *userValidator) needsRehash(user *User) bool {
+	if user.PepperVersion != uv.peppers.Current().Version {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(user.PasswordHash))
+	return err != nil || cost != uv.policy.Cost
+}
@@ -0,0 +1,30 @@
+package models
+
+// Pepper is a secret appended to passwords before hashing. Its Version is stored
+// on every user hashed with it, so peppers can be rotated without breaking logins
+type Pepper struct {
+	Version int
+	Secret  string
+}
+
+// Peppers are the current pepper followed by the previous ones still accepted
+type Peppers []Pepper
+
+// Current is the pepper new password hashes are made with
+func (p Peppers) Current() Pepper {
+	return p[0]
+}
+
+// candidates returns the peppers a hash with the given version may have been made with.
+// Version 0 means the hash predates pepper versions, so every pepper is tried, current first
+func (p Peppers) candidates(version int) []Pepper {
+	if version == 0 {
+		return p
+	}
+	for _, pepper := range p {
+		if pepper.Version == version {
+			return []Pepper{pepper}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrNameRequired is returned when a product is saved without a name
+	ErrNameRequired modelError = "models: name is required"
+
+	// ErrSKURequired is returned when a product is saved without a SKU
+	ErrSKURequired modelError = "models: SKU is required"
+
+	// ErrSKUTaken is returned when another product already uses the provided SKU
+	ErrSKUTaken modelError = "models: SKU is already taken"
+
+	// ErrSlugTaken is returned when another product already uses the generated or provided slug
+	ErrSlugTaken modelError = "models: slug is already taken"
+
+	// ErrSlugInvalid is returned when a slug ends up empty after removing invalid characters
+	ErrSlugInvalid modelError = "models: slug must contain letters or digits"
+
+	// ErrPriceInvalid is returned when a product price is zero or negative
+	ErrPriceInvalid modelError = "models: price must be greater than zero"
+)
+
+// Product is a single item in the catalog. Price is stored in integer cents
+// to avoid floating point rounding errors
+type Product struct {
+	gorm.Model
+	Name        string `gorm:"not null"`
+	SKU         string `gorm:"not null;unique_index"`
+	Slug        string `gorm:"not null;unique_index"`
+	Description string
+	Price       int `gorm:"not null"`
+}
+
+type ProductDB interface {
+	// Methods for querying products
+	ByID(id uint) (*Product, error)
+	BySKU(sku string) (*Product, error)
+	BySlug(slug string) (*Product, error)
+	All() ([]Product, error)
+
+	// Methods for altering products
+	Create(product *Product) error
+	Update(product *Product) error
+	Delete(id uint) error
+}
+
+type ProductService interface {
+	ProductDB
+}
+
+type productService struct {
+	ProductDB
+}
+
+type productValidator struct {
+	ProductDB
+}
+
+type productGorm struct {
+	db *gorm.DB
+}
+
+var _ ProductDB = &productGorm{}
+var _ ProductService = &productService{}
+
+type productValFn func(*Product) error
+
+// NewProductService builds a ProductService on top of the connection shared by Services
+func NewProductService(db *gorm.DB) ProductService {
+	return newProductService(&productGorm{db: db})
+}
+
+func newProductService(db ProductDB) ProductService {
+	return &productService{
+		ProductDB: &productValidator{
+			ProductDB: db,
+		},
+	}
+}
+
+// ByID will look up a product with the provided ID
+// If the product is not found, return ErrNotFound
+func (pg *productGorm) ByID(id uint) (*Product, error) {
+	var product Product
+	err := first(pg.db.Where("id = ?", id), &product)
+	if err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// BySKU will look up a product with the provided SKU
+// Errors are the same as ByID
+func (pg *productGorm) BySKU(sku string) (*Product, error) {
+	var product Product
+	err := first(pg.db.Where("sku = ?", sku), &product)
+	if err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+func (pv *productValidator) BySKU(sku string) (*Product, error) {
+	product := Product{
+		SKU: sku,
+	}
+	if err := runProductValFns(&product, pv.normalizeSKU); err != nil {
+		return nil, err
+	}
+
+	return pv.ProductDB.BySKU(product.SKU)
+}
+
+// BySlug will look up a product with the provided slug
+// Errors are the same as ByID
+func (pg *productGorm) BySlug(slug string) (*Product, error) {
+	var product Product
+	err := first(pg.db.Where("slug = ?", slug), &product)
+	if err != nil {
+		return nil, err
+	}
+	return &product, nil
+}
+
+// All returns every product in the catalog ordered by name
+func (pg *productGorm) All() ([]Product, error) {
+	var products []Product
+	err := pg.db.Order("name").Find(&products).Error
+	if err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+// Create will create the provided product and backfill data like the ID, CreatedAt, UpdatedAt fields
+func (pg *productGorm) Create(product *Product) error {
+	return pg.db.Create(product).Error
+}
+func (pv *productValidator) Create(product *Product) error {
+	err := runProductValFns(product,
+		pv.requireName,
+		pv.normalizeSKU,
+		pv.requireSKU,
+		pv.skuIsAvailable,
+		pv.priceGreaterThanZero,
+		pv.setSlugIfUnset,
+		pv.normalizeSlug,
+		pv.requireSlug,
+		pv.slugIsAvailable)
+	if err != nil {
+		return err
+	}
+
+	return pv.ProductDB.Create(product)
+}
+
+// Update will update the provided product with all of the data in the provided product object
+func (pg *productGorm) Update(product *Product) error {
+	return pg.db.Save(product).Error
+}
+func (pv *productValidator) Update(product *Product) error {
+	err := runProductValFns(product,
+		pv.requireName,
+		pv.normalizeSKU,
+		pv.requireSKU,
+		pv.skuIsAvailable,
+		pv.priceGreaterThanZero,
+		pv.setSlugIfUnset,
+		pv.normalizeSlug,
+		pv.requireSlug,
+		pv.slugIsAvailable)
+	if err != nil {
+		return err
+	}
+
+	return pv.ProductDB.Update(product)
+}
+
+// Delete will delete the product with the provided ID
+func (pg *productGorm) Delete(id uint) error {
+	product := Product{Model: gorm.Model{ID: id}}
+	return pg.db.Delete(&product).Error
+}
+func (pv *productValidator) Delete(id uint) error {
+	var product Product
+	product.ID = id
+	if err := runProductValFns(&product, pv.idGreaterThan(0)); err != nil {
+		return err
+	}
+
+	return pv.ProductDB.Delete(id)
+}
+
+// runProductValFns works the same way as runUserValFns but for products
+func runProductValFns(product *Product, functions ...productValFn) error {
+	for _, fn := range functions {
+		if err := fn(product); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requireName makes sure a product name has been provided
+func (pv *productValidator) requireName(product *Product) error {
+	product.Name = strings.TrimSpace(product.Name)
+	if product.Name == "" {
+		return ErrNameRequired
+	}
+	return nil
+}
+
+// normalizeSKU trims the SKU and transforms it to uppercase
+func (pv *productValidator) normalizeSKU(product *Product) error {
+	product.SKU = strings.ToUpper(strings.TrimSpace(product.SKU))
+	return nil
+}
+
+// requireSKU makes sure a SKU has been provided
+func (pv *productValidator) requireSKU(product *Product) error {
+	if product.SKU == "" {
+		return ErrSKURequired
+	}
+	return nil
+}
+
+// skuIsAvailable works like emailIsAvailable, returning ErrSKUTaken
+// when a different product already uses the SKU
+func (pv *productValidator) skuIsAvailable(product *Product) error {
+	existing, err := pv.BySKU(product.SKU)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if product.ID != existing.ID {
+		return ErrSKUTaken
+	}
+	return nil
+}
+
+// priceGreaterThanZero makes sure the price (in cents) is a positive amount
+func (pv *productValidator) priceGreaterThanZero(product *Product) error {
+	if product.Price <= 0 {
+		return ErrPriceInvalid
+	}
+	return nil
+}
+
+// setSlugIfUnset generates a slug from the product name when one was not provided
+func (pv *productValidator) setSlugIfUnset(product *Product) error {
+	if product.Slug != "" {
+		return nil
+	}
+	product.Slug = product.Name
+	return nil
+}
+
+var slugInvalidChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// normalizeSlug lowercases the slug and collapses anything that is not
+// a letter or a digit into a single dash, e.g. "Blue T-Shirt (XL)" becomes "blue-t-shirt-xl"
+func (pv *productValidator) normalizeSlug(product *Product) error {
+	slug := strings.ToLower(product.Slug)
+	slug = slugInvalidChars.ReplaceAllString(slug, "-")
+	product.Slug = strings.Trim(slug, "-")
+	return nil
+}
+
+// requireSlug makes sure the normalized slug is not empty
+func (pv *productValidator) requireSlug(product *Product) error {
+	if product.Slug == "" {
+		return ErrSlugInvalid
+	}
+	return nil
+}
+
+// slugIsAvailable makes sure no other product uses the same slug
+func (pv *productValidator) slugIsAvailable(product *Product) error {
+	existing, err := pv.BySlug(product.Slug)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if product.ID != existing.ID {
+		return ErrSlugTaken
+	}
+	return nil
+}
+
+// idGreaterThan will ensure a valid ID for delete
+func (pv *productValidator) idGreaterThan(n uint) productValFn {
+	return productValFn(func(product *Product) error {
+		if product.ID <= n {
+			return ErrIdInvalid
+		}
+		return nil
+	})
+}
@@ -0,0 +1,184 @@
+package models
+
+import (
+	"time"
+
+	"ecommerce/hash"
+	"ecommerce/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// pwResetTTL is how long a password reset token can be used for
+	pwResetTTL = time.Hour
+
+	// pwResetTokenBytes is the size of the random reset token
+	pwResetTokenBytes = 32
+)
+
+// PasswordReset is a pending password reset. Only the HMAC of the token is stored,
+// the token itself is only known to whoever received the email
+type PasswordReset struct {
+	gorm.Model
+	UserID    uint      `gorm:"not null;index"`
+	Token     string    `gorm:"-"`
+	TokenHash string    `gorm:"not null;unique_index"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+type pwResetDB interface {
+	// ByToken looks up a reset that has not expired yet
+	ByToken(token string) (*PasswordReset, error)
+	Create(pwr *PasswordReset) error
+	Delete(id uint) error
+
+	// DeleteByUserID deletes every reset of the user, so older links stop working
+	DeleteByUserID(userID uint) error
+}
+
+type pwResetValidator struct {
+	pwResetDB
+	keyring *hash.Keyring
+}
+
+type pwResetGorm struct {
+	db *gorm.DB
+}
+
+var _ pwResetDB = &pwResetGorm{}
+
+type pwResetValFn func(*PasswordReset) error
+
+func newPwResetValidator(db pwResetDB, keyring *hash.Keyring) *pwResetValidator {
+	return &pwResetValidator{
+		pwResetDB: db,
+		keyring:   keyring,
+	}
+}
+
+// ByToken will look up a reset with the provided token hash
+// If the reset is not found or expired, return ErrNotFound
+func (pwrg *pwResetGorm) ByToken(tokenHash string) (*PasswordReset, error) {
+	var pwr PasswordReset
+	db := pwrg.db.Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now())
+	err := first(db, &pwr)
+	if err != nil {
+		return nil, err
+	}
+	return &pwr, nil
+}
+// The token is hashed with the current key first, then with the previous ones
+func (pwrv *pwResetValidator) ByToken(token string) (*PasswordReset, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+
+	for _, tokenHash := range pwrv.keyring.HashAll(token) {
+		pwr, err := pwrv.pwResetDB.ByToken(tokenHash)
+		if err == ErrNotFound {
+			continue
+		}
+		return pwr, err
+	}
+	return nil, ErrNotFound
+}
+
+// Create will create the provided reset, generating its token
+func (pwrg *pwResetGorm) Create(pwr *PasswordReset) error {
+	return pwrg.db.Create(pwr).Error
+}
+func (pwrv *pwResetValidator) Create(pwr *PasswordReset) error {
+	err := runPwResetValFns(pwr,
+		pwrv.requireUserID,
+		pwrv.setTokenIfUnset,
+		pwrv.hmacToken,
+		pwrv.setExpiresAtIfUnset)
+	if err != nil {
+		return err
+	}
+
+	return pwrv.pwResetDB.Create(pwr)
+}
+
+// Delete will delete the reset with the provided ID, so its token can not be used again
+// If the reset is not found or already deleted, return ErrNotFound. Only one of two
+// concurrent deletes of the same reset succeeds
+func (pwrg *pwResetGorm) Delete(id uint) error {
+	pwr := PasswordReset{Model: gorm.Model{ID: id}}
+	db := pwrg.db.Delete(&pwr)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+func (pwrv *pwResetValidator) Delete(id uint) error {
+	if id == 0 {
+		return ErrIdInvalid
+	}
+
+	return pwrv.pwResetDB.Delete(id)
+}
+
+// DeleteByUserID will delete every reset of the user with the provided ID
+func (pwrg *pwResetGorm) DeleteByUserID(userID uint) error {
+	return pwrg.db.Where("user_id = ?", userID).Delete(&PasswordReset{}).Error
+}
+func (pwrv *pwResetValidator) DeleteByUserID(userID uint) error {
+	if userID == 0 {
+		return ErrIdInvalid
+	}
+
+	return pwrv.pwResetDB.DeleteByUserID(userID)
+}
+
+// runPwResetValFns works the same way as runUserValFns but for password resets
+func runPwResetValFns(pwr *PasswordReset, functions ...pwResetValFn) error {
+	for _, fn := range functions {
+		if err := fn(pwr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requireUserID makes sure the reset belongs to a user
+func (pwrv *pwResetValidator) requireUserID(pwr *PasswordReset) error {
+	if pwr.UserID == 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+// setTokenIfUnset generates a random token for new resets
+func (pwrv *pwResetValidator) setTokenIfUnset(pwr *PasswordReset) error {
+	if pwr.Token != "" {
+		return nil
+	}
+	token, err := rand.String(pwResetTokenBytes)
+	if err != nil {
+		return err
+	}
+	pwr.Token = token
+	return nil
+}
+
+// hmacToken hashes the token if present with the current key
+func (pwrv *pwResetValidator) hmacToken(pwr *PasswordReset) error {
+	if pwr.Token == "" {
+		return nil
+	}
+	pwr.TokenHash = pwrv.keyring.Hash(pwr.Token)
+	return nil
+}
+
+// setExpiresAtIfUnset makes new resets expire after pwResetTTL
+func (pwrv *pwResetValidator) setExpiresAtIfUnset(pwr *PasswordReset) error {
+	if pwr.ExpiresAt.IsZero() {
+		pwr.ExpiresAt = time.Now().Add(pwResetTTL)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCompleteReset(t *testing.T) {
+	eachStorage(t, func(t *testing.T, s *Services) {
+		createUser(t, s, "jon@example.com")
+		older, err := s.User.InitiateReset("jon@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := s.User.InitiateReset("jon@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name     string
+			token    string
+			password string
+			want     error
+		}{
+			{"replaced token", older, "a brand new password", ErrTokenInvalid},
+			{"unknown token", "unknown-token", "a brand new password", ErrTokenInvalid},
+			{"password too short", token, "short", ErrPasswordTooShort},
+			{"token kept after a refused password", token, "a brand new password", nil},
+			{"used token", token, "another new password", ErrTokenInvalid},
+		}
+		for _, tt := range tests {
+			if _, err := s.User.CompleteReset(tt.token, tt.password); err != tt.want {
+				t.Fatalf("%s: got error %v, want %v", tt.name, err, tt.want)
+			}
+		}
+		if _, err := s.User.Authenticate("jon@example.com", "a brand new password"); err != nil {
+			t.Fatalf("signing in with the new password: %v", err)
+		}
+	})
+}
+
+func TestCompleteResetConcurrently(t *testing.T) {
+	eachStorage(t, func(t *testing.T, s *Services) {
+		createUser(t, s, "jon@example.com")
+		token, err := s.User.InitiateReset("jon@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		passwords := []string{"first new password", "second new password"}
+		errs := make([]error, len(passwords))
+		var wg sync.WaitGroup
+		for i, password := range passwords {
+			wg.Add(1)
+			go func(i int, password string) {
+				defer wg.Done()
+				_, errs[i] = s.User.CompleteReset(token, password)
+			}(i, password)
+		}
+		wg.Wait()
+
+		succeeded := 0
+		for _, err := range errs {
+			switch err {
+			case nil:
+				succeeded++
+			case ErrTokenInvalid:
+			default:
+				t.Fatalf("got error %v, want nil or ErrTokenInvalid", err)
+			}
+		}
+		if succeeded != 1 {
+			t.Fatalf("the token was used %d times, want once", succeeded)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"ecommerce/hash"
+)
+
+// RekeyReport counts the stored hashes that still depend on previous keys
+type RekeyReport struct {
+	// Sessions and PasswordResets hashed with a previous HMAC key, or before key IDs existed
+	Sessions       int
+	PasswordResets int
+
+	// RecoveryCodes hashed with a previous HMAC key, these are never expired
+	// since that would leave their users without a way around a lost device
+	RecoveryCodes int
+
+	// Users whose password hash was made with a previous pepper
+	Users int
+}
+
+// Rekey finds the stored hashes not made with the current HMAC key of keyring or
+// the pepper with pepperVersion. HMAC digests can not be recomputed without the tokens
+// they hide, and passwords are only known at login where Authenticate re-hashes them,
+// so nothing can be rewritten in place. With expire set, sessions and password resets
+// using previous keys are deleted instead, signing those devices out, after which the
+// previous HMAC keys can be removed from the configuration. Users still on a previous
+// pepper are only counted: removing their pepper means they need a password reset
+func (s *Services) Rekey(keyring *hash.Keyring, pepperVersion int, expire bool) (*RekeyReport, error) {
+	if s.db == nil {
+		return nil, errNoDatabase
+	}
+	var report RekeyReport
+
+	prefix := keyring.CurrentID() + hash.KeySeparator
+	stale := "substr(token_hash, 1, ?) <> ?"
+
+	tokenTables := []struct {
+		model interface{}
+		count *int
+	}{
+		{&Session{}, &report.Sessions},
+		{&PasswordReset{}, &report.PasswordResets},
+	}
+	for _, t := range tokenTables {
+		err := s.db.Model(t.model).Where(stale, len(prefix), prefix).Count(t.count).Error
+		if err != nil {
+			return nil, err
+		}
+		if !expire || *t.count == 0 {
+			continue
+		}
+		if err := s.db.Where(stale, len(prefix), prefix).Delete(t.model).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	err := s.db.Model(&RecoveryCode{}).
+		Where("used_at IS NULL AND substr(code_hash, 1, ?) <> ?", len(prefix), prefix).
+		Count(&report.RecoveryCodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.Model(&User{}).Where("pepper_version <> ?", pepperVersion).Count(&report.Users).Error
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
@@ -0,0 +1,84 @@
+package models
+
+// Roles a user can have, see rolePermissions for what each of them allows
+const (
+	RoleCustomer = "customer"
+	RoleStaff    = "staff"
+	RoleAdmin    = "admin"
+)
+
+// Roles lists every role, least privileged first
+var Roles = []string{RoleCustomer, RoleStaff, RoleAdmin}
+
+// Permission is something only some roles are allowed to do
+type Permission string
+
+const (
+	PermManageProducts  Permission = "manage_products"
+	PermManageInventory Permission = "manage_inventory"
+	PermManageOrders    Permission = "manage_orders"
+	PermManageUsers     Permission = "manage_users"
+)
+
+// rolePermissions maps each role to what it is allowed to do. Staff run the
+// store, only admins can change who has which role
+var rolePermissions = map[string][]Permission{
+	RoleCustomer: {},
+	RoleStaff:    {PermManageProducts, PermManageInventory, PermManageOrders},
+	RoleAdmin:    {PermManageProducts, PermManageInventory, PermManageOrders, PermManageUsers},
+}
+
+var (
+	// ErrRoleInvalid is returned when a user is saved with an unknown role
+	ErrRoleInvalid modelError = "models: role is not valid"
+
+	// ErrTOTPRequiredForRole is returned when an admin tries to turn two-factor authentication off
+	ErrTOTPRequiredForRole modelError = "models: admins must keep two-factor authentication on"
+)
+
+// HasRole reports whether the user has one of the roles
+func (u *User) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if u.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether the role of the user grants the permission
+func (u *User) Can(perm Permission) bool {
+	for _, p := range rolePermissions[u.Role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// RequiresTOTP reports whether the role of the user requires two-factor authentication
+func (u *User) RequiresTOTP() bool {
+	return u.Role == RoleAdmin
+}
+
+// NeedsTOTP reports whether the role of the user requires two-factor
+// authentication and they have not turned it on yet
+func (u *User) NeedsTOTP() bool {
+	return u.RequiresTOTP() && !u.TOTPEnabled
+}
+
+// setRoleIfUnset makes new users customers unless a role was given
+func (uv *userValidator) setRoleIfUnset(user *User) error {
+	if user.Role == "" {
+		user.Role = RoleCustomer
+	}
+	return nil
+}
+
+// roleValid makes sure the role is one of the known roles
+func (uv *userValidator) roleValid(user *User) error {
+	if _, ok := rolePermissions[user.Role]; !ok {
+		return ErrRoleInvalid
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"database/sql"
+	"ecommerce/encrypt"
+	"ecommerce/hash"
+	"errors"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// ServicesConfig is a functional option applied by NewServices
+type ServicesConfig func(*Services) error
+
+// errNoDatabase is returned when something needing SQL is used with WithMemory
+var errNoDatabase = errors.New("models: no database connection, WithGorm is required")
+
+// WithGorm opens the database connection shared by every service,
+// it must come before any option building a service. dialect is postgres or sqlite3
+func WithGorm(dialect, connectionInfo string) ServicesConfig {
+	return func(s *Services) error {
+		db, err := gorm.Open(dialect, connectionInfo)
+		if err != nil {
+			return err
+		}
+		if dialect == "sqlite3" {
+			// SQLite allows one writer at a time, a single connection queues
+			// the writes instead of failing them with "database is locked"
+			db.DB().SetMaxOpenConns(1)
+		}
+		s.db = db
+		return nil
+	}
+}
+
+// WithMemory keeps every row in memory instead of a database, so tests and local
+// development can run without one. It takes the place of WithGorm, the services
+// built after it and Transaction use the memory store
+func WithMemory() ServicesConfig {
+	return func(s *Services) error {
+		s.memory = newMemoryStore()
+		return nil
+	}
+}
+
+// WithLogMode turns SQL logging on or off, there is nothing to log with WithMemory
+func WithLogMode(mode bool) ServicesConfig {
+	return func(s *Services) error {
+		if s.db == nil {
+			return nil
+		}
+		s.db = s.db.Set(logModeKey, mode).LogMode(mode)
+		return nil
+	}
+}
+
+// WithUser builds the UserService, the current pepper is appended to passwords
+// before hashing, keyring is used to hash session and reset tokens and policy
+// decides which passwords are accepted. totpCipher encrypts TOTP secrets
+func WithUser(peppers Peppers, keyring *hash.Keyring, policy PasswordPolicy, totpCipher *encrypt.AESGCM) ServicesConfig {
+	// bcrypt is slow on purpose, the hash is made once and not for every Transaction
+	dummyHash, err := newDummyHash(peppers, policy)
+	return service(func(s *Services) error {
+		if err != nil {
+			return err
+		}
+		if s.memory != nil {
+			s.User = newUserMemoryService(s.memory, peppers, keyring, policy, totpCipher, dummyHash)
+			return nil
+		}
+		s.User = newUserGormService(s.db, peppers, keyring, policy, totpCipher, dummyHash)
+		return nil
+	})
+}
+
+// WithSession builds the SessionService, keyring must be the same one given to WithUser
+func WithSession(keyring *hash.Keyring) ServicesConfig {
+	return service(func(s *Services) error {
+		if s.memory != nil {
+			s.Session = newSessionService(&sessionMemory{store: s.memory}, keyring)
+			return nil
+		}
+		s.Session = NewSessionService(s.db, keyring)
+		return nil
+	})
+}
+
+// WithProduct builds the ProductService
+func WithProduct() ServicesConfig {
+	return service(func(s *Services) error {
+		if s.memory != nil {
+			s.Product = newProductService(&productMemory{store: s.memory})
+			return nil
+		}
+		s.Product = NewProductService(s.db)
+		return nil
+	})
+}
+
+// WithCart builds the CartService
+func WithCart() ServicesConfig {
+	return service(func(s *Services) error {
+		if s.memory != nil {
+			s.Cart = newCartService(&cartMemory{store: s.memory}, &productMemory{store: s.memory})
+			return nil
+		}
+		s.Cart = NewCartService(s.db)
+		return nil
+	})
+}
+
+// WithOrder builds the OrderService
+func WithOrder() ServicesConfig {
+	return service(func(s *Services) error {
+		if s.memory != nil {
+			s.Order = newOrderMemoryService(s.memory)
+			return nil
+		}
+		s.Order = NewOrderService(s.db)
+		return nil
+	})
+}
+
+// WithInventory builds the InventoryService
+func WithInventory() ServicesConfig {
+	return service(func(s *Services) error {
+		if s.memory != nil {
+			s.Inventory = newInventoryService(&inventoryMemory{store: s.memory})
+			return nil
+		}
+		s.Inventory = NewInventoryService(s.db)
+		return nil
+	})
+}
+
+// service wraps an option building a service from s.db or s.memory, remembering it
+// so Transaction can build the service again on top of the transaction
+func service(build func(s *Services) error) ServicesConfig {
+	return func(s *Services) error {
+		if err := build(s); err != nil {
+			return err
+		}
+		s.builders = append(s.builders, build)
+		return nil
+	}
+}
+
+// NewServices applies each config in order, e.g.
+//
+//	models.NewServices(
+//		models.WithGorm("postgres", connectionInfo),
+//		models.WithUser(peppers, keyring, policy, totpCipher),
+//		models.WithProduct(),
+//	)
+func NewServices(cfgs ...ServicesConfig) (*Services, error) {
+	var s Services
+	for _, cfg := range cfgs {
+		if err := cfg(&s); err != nil {
+			return nil, err
+		}
+	}
+	return &s, nil
+}
+
+// Services groups all the services sharing the same database connection
+type Services struct {
+	User      UserService
+	Session   SessionService
+	Product   ProductService
+	Cart      CartService
+	Order     OrderService
+	Inventory InventoryService
+	db        *gorm.DB
+	memory    *memoryStore
+	builders  []func(*Services) error
+}
+
+// Close closes the database connection shared by all services
+func (s *Services) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// DB returns the connection pool shared by all services, e.g. for migrations.
+// The schema is managed by the migrations package, not by the services.
+// It is nil with WithMemory
+func (s *Services) DB() *sql.DB {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.DB()
+}
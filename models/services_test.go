@@ -0,0 +1,84 @@
+package models
+
+import (
+	"path/filepath"
+	"testing"
+
+	"ecommerce/encrypt"
+	"ecommerce/hash"
+	"ecommerce/migrations"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newServices builds every service on top of storage, WithMemory or WithGorm
+func newServices(t *testing.T, storage ServicesConfig) *Services {
+	t.Helper()
+
+	keyring, err := hash.NewKeyring(hash.Key{ID: "1", Secret: "test-hmac-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	totpCipher, err := encrypt.NewAESGCM("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := PasswordPolicy{
+		MinLength: passwordMinLength,
+		MaxLength: 56,
+		Cost:      bcrypt.MinCost,
+	}
+
+	s, err := NewServices(
+		storage,
+		WithUser(Peppers{{Version: 1, Secret: "test-pepper"}}, keyring, policy, totpCipher),
+		WithSession(keyring),
+		WithProduct(),
+		WithCart(),
+		WithOrder(),
+		WithInventory(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newMemoryServices builds every service on top of a fresh memory store
+func newMemoryServices(t *testing.T) *Services {
+	t.Helper()
+	return newServices(t, WithMemory())
+}
+
+// newSQLiteServices builds every service on top of a migrated SQLite database
+// in the test's temporary directory
+func newSQLiteServices(t *testing.T) *Services {
+	t.Helper()
+
+	s := newServices(t, WithGorm("sqlite3", filepath.Join(t.TempDir(), "test.db")))
+	t.Cleanup(func() { s.Close() })
+	m, err := migrations.New(s.DB(), "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// eachStorage runs test once with memory services and once with SQLite services
+func eachStorage(t *testing.T, test func(t *testing.T, s *Services)) {
+	storages := []struct {
+		name string
+		new  func(t *testing.T) *Services
+	}{
+		{"memory", newMemoryServices},
+		{"sqlite3", newSQLiteServices},
+	}
+	for _, storage := range storages {
+		t.Run(storage.name, func(t *testing.T) {
+			test(t, storage.new(t))
+		})
+	}
+}
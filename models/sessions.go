@@ -0,0 +1,245 @@
+package models
+
+import (
+	"time"
+
+	"ecommerce/hash"
+	"ecommerce/rand"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// SessionLifetime is how long a device stays signed in
+	SessionLifetime = 30 * 24 * time.Hour
+
+	// sessionTouchInterval limits how often LastSeenAt is written,
+	// so busy sessions do not cause a database write on every request
+	sessionTouchInterval = time.Minute
+)
+
+// Session is a device signed in to a user account. Only the HMAC of the token is
+// stored, the token itself is only known to the device holding the cookie
+type Session struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	UserAgent  string
+	IP         string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time `gorm:"not null;index"`
+}
+
+type SessionDB interface {
+	// Methods for querying sessions, expired sessions are never returned
+	ByToken(token string) (*Session, error)
+	ByUserID(userID uint) ([]Session, error)
+
+	// Methods for altering sessions
+	Create(session *Session) error
+	Touch(session *Session) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type SessionService interface {
+	SessionDB
+}
+
+type sessionService struct {
+	SessionDB
+}
+
+type sessionValidator struct {
+	SessionDB
+	keyring *hash.Keyring
+}
+
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+var _ SessionDB = &sessionGorm{}
+var _ SessionService = &sessionService{}
+
+type sessionValFn func(*Session) error
+
+// NewSessionService builds a SessionService on top of the connection shared by Services,
+// tokens are hashed with the current key of keyring
+func NewSessionService(db *gorm.DB, keyring *hash.Keyring) SessionService {
+	return newSessionService(&sessionGorm{db: db}, keyring)
+}
+
+func newSessionService(db SessionDB, keyring *hash.Keyring) SessionService {
+	return &sessionService{
+		SessionDB: newSessionValidator(db, keyring),
+	}
+}
+
+func newSessionValidator(db SessionDB, keyring *hash.Keyring) *sessionValidator {
+	return &sessionValidator{
+		SessionDB: db,
+		keyring:   keyring,
+	}
+}
+
+// ByToken will look up an active session with the provided token hash
+// If the session is not found or expired, return ErrNotFound
+func (sg *sessionGorm) ByToken(tokenHash string) (*Session, error) {
+	var session Session
+	db := sg.db.Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now())
+	err := first(db, &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+// The token is hashed with the current key first, then with the previous ones
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+
+	for _, tokenHash := range sv.keyring.HashAll(token) {
+		session, err := sv.SessionDB.ByToken(tokenHash)
+		if err == ErrNotFound {
+			continue
+		}
+		return session, err
+	}
+	return nil, ErrNotFound
+}
+
+// ByUserID returns the active sessions of the user, most recently used first
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	err := sg.db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at desc").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Create will create the provided session, generating its token
+func (sg *sessionGorm) Create(session *Session) error {
+	return sg.db.Create(session).Error
+}
+func (sv *sessionValidator) Create(session *Session) error {
+	err := runSessionValFns(session,
+		sv.userIDRequired,
+		sv.setTokenIfUnset,
+		sv.hmacToken,
+		sv.setTimestamps)
+	if err != nil {
+		return err
+	}
+
+	return sv.SessionDB.Create(session)
+}
+
+// Touch records that the session was just used
+func (sg *sessionGorm) Touch(session *Session) error {
+	return sg.db.Model(session).UpdateColumn("last_seen_at", session.LastSeenAt).Error
+}
+func (sv *sessionValidator) Touch(session *Session) error {
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) < sessionTouchInterval {
+		return nil
+	}
+	session.LastSeenAt = now
+
+	return sv.SessionDB.Touch(session)
+}
+
+// Delete will delete the session with the provided ID, signing that device out
+func (sg *sessionGorm) Delete(id uint) error {
+	session := Session{Model: gorm.Model{ID: id}}
+	return sg.db.Delete(&session).Error
+}
+func (sv *sessionValidator) Delete(id uint) error {
+	var session Session
+	session.ID = id
+	if err := runSessionValFns(&session, sv.idGreaterThan(0)); err != nil {
+		return err
+	}
+
+	return sv.SessionDB.Delete(id)
+}
+
+// DeleteByUserID deletes every session of the user, signing them out everywhere
+func (sg *sessionGorm) DeleteByUserID(userID uint) error {
+	return sg.db.Where("user_id = ?", userID).Delete(&Session{}).Error
+}
+func (sv *sessionValidator) DeleteByUserID(userID uint) error {
+	session := Session{
+		UserID: userID,
+	}
+	if err := runSessionValFns(&session, sv.userIDRequired); err != nil {
+		return err
+	}
+
+	return sv.SessionDB.DeleteByUserID(userID)
+}
+
+// runSessionValFns works the same way as runUserValFns but for sessions
+func runSessionValFns(session *Session, functions ...sessionValFn) error {
+	for _, fn := range functions {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userIDRequired makes sure the session belongs to a user
+func (sv *sessionValidator) userIDRequired(session *Session) error {
+	if session.UserID == 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+// setTokenIfUnset generates a random token for new sessions
+func (sv *sessionValidator) setTokenIfUnset(session *Session) error {
+	if session.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	session.Token = token
+	return nil
+}
+
+// hmacToken hashes the token if present with the current key
+func (sv *sessionValidator) hmacToken(session *Session) error {
+	if session.Token == "" {
+		return nil
+	}
+	session.TokenHash = sv.keyring.Hash(session.Token)
+	return nil
+}
+
+// setTimestamps starts LastSeenAt now and sets the expiry if unset
+func (sv *sessionValidator) setTimestamps(session *Session) error {
+	now := time.Now()
+	session.LastSeenAt = now
+	if session.ExpiresAt.IsZero() {
+		session.ExpiresAt = now.Add(SessionLifetime)
+	}
+	return nil
+}
+
+// idGreaterThan will ensure a valid ID for delete
+func (sv *sessionValidator) idGreaterThan(n uint) sessionValFn {
+	return sessionValFn(func(session *Session) error {
+		if session.ID <= n {
+			return ErrIdInvalid
+		}
+		return nil
+	})
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signUserToken returns a token "<user id>.<expiry>.<signature>" that needs nothing stored.
+// The signature covers purpose, so a token can not be used for anything else, and bind,
+// some state of the user that invalidates the token once it changes
+func (us *userService) signUserToken(purpose string, user *User, bind string, ttl time.Duration) (string, error) {
+	if user.ID == 0 {
+		return "", ErrIdInvalid
+	}
+	expires := time.Now().Add(ttl).Unix()
+	payload := fmt.Sprintf("%d.%d", user.ID, expires)
+	return payload + "." + us.keyring.Hash(signedPayload(purpose, payload, bind)), nil
+}
+
+// parseUserToken checks a token from signUserToken and returns the user it was issued to.
+// bind must return the same state given to signUserToken
+// If the token is malformed, expired or its signature does not match, this will return ErrTokenInvalid
+func (us *userService) parseUserToken(purpose, token string, bind func(*User) string) (*User, error) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, ErrTokenInvalid
+	}
+
+	user, err := us.ByID(uint(id))
+	if err == ErrNotFound {
+		return nil, ErrTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	payload := parts[0] + "." + parts[1]
+	if !us.keyring.Equal(signedPayload(purpose, payload, bind(user)), parts[2]) {
+		return nil, ErrTokenInvalid
+	}
+	return user, nil
+}
+
+// signedPayload is what gets signed, prefixed with the purpose so the signature
+// can not be mistaken for any other HMAC made with the same key
+func signedPayload(purpose, payload, bind string) string {
+	return purpose + ":" + payload + ":" + bind
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Transaction runs fn with services whose queries all go through one database
+// transaction: it is committed when fn returns nil and rolled back when fn returns
+// an error or panics, the panic carrying on once the transaction is rolled back.
+// tx has the same services as s, built again on top of the transaction, and must
+// not be used after fn returns. Calling Transaction on tx nests a savepoint instead.
+// With WithMemory the transaction is the one of the memory store
+func (s *Services) Transaction(fn func(tx *Services) error) error {
+	return s.TransactionContext(context.Background(), fn)
+}
+
+// TransactionContext is Transaction with the transaction begun with ctx, so it is
+// rolled back and its queries cancelled once ctx is done
+func (s *Services) TransactionContext(ctx context.Context, fn func(tx *Services) error) error {
+	if s.memory != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return s.memory.transaction(func(memory *memoryStore) error {
+			return s.inTransaction(&Services{memory: memory}, fn)
+		})
+	}
+
+	return inTransaction(withContext(s.db, ctx), func(db *gorm.DB) error {
+		return s.inTransaction(&Services{db: db}, fn)
+	})
+}
+
+// inTransaction builds the services of s again on top of the transaction of tx and runs fn
+func (s *Services) inTransaction(tx *Services, fn func(tx *Services) error) error {
+	tx.builders = s.builders
+	for _, build := range s.builders {
+		if err := build(tx); err != nil {
+			return err
+		}
+	}
+	return fn(tx)
+}
+
+// inTransaction runs fn in a transaction on db, committed if fn returns nil and rolled
+// back otherwise. When db already is a transaction, e.g. inside Services.Transaction,
+// fn runs in a savepoint so only its own changes are undone on error and the outer
+// transaction decides about the commit
+func inTransaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	if _, ok := db.CommonDB().(*sql.Tx); ok {
+		return inSavepoint(db, fn)
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// inSavepoint is inTransaction for a db already in a transaction. Postgres and SQLite
+// both allow reusing the savepoint name, ROLLBACK TO and RELEASE pick the innermost one.
+// Rolling back to the savepoint also recovers a Postgres transaction after a failed statement
+func inSavepoint(tx *gorm.DB, fn func(tx *gorm.DB) error) error {
+	if err := tx.Exec("SAVEPOINT nested").Error; err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			rollbackSavepoint(tx)
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		rollbackSavepoint(tx)
+		return err
+	}
+	return tx.Exec("RELEASE SAVEPOINT nested").Error
+}
+
+// rollbackSavepoint undoes the changes made since the innermost savepoint and drops it
+func rollbackSavepoint(tx *gorm.DB) {
+	tx.Exec("ROLLBACK TO SAVEPOINT nested")
+	tx.Exec("RELEASE SAVEPOINT nested")
+}
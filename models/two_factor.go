@@ -0,0 +1,390 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"ecommerce/hash"
+	"ecommerce/rand"
+	"ecommerce/totp"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// loginTokenTTL is how long the second step of a login can take after the password was accepted
+	loginTokenTTL     = 5 * time.Minute
+	loginTokenPurpose = "totp-login"
+
+	// recoveryCodeCount is how many recovery codes a user gets at once,
+	// each is recoveryCodeBytes of randomness, 12 characters once encoded
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 9
+)
+
+var (
+	// ErrTOTPRequired is returned by Authenticate along with the user when the password
+	// is right but the account has two-factor authentication, finish with VerifyTOTP
+	ErrTOTPRequired modelError = "models: enter the code from your authenticator app or a recovery code"
+
+	// ErrTOTPInvalid is returned when a two-factor code is wrong, expired or was already used
+	ErrTOTPInvalid modelError = "models: the code is not valid, check the clock of your device or use a recovery code"
+
+	// ErrTOTPEnabled is returned when enrolling a user who already has two-factor authentication
+	ErrTOTPEnabled modelError = "models: two-factor authentication is already enabled"
+
+	// ErrTOTPNotEnabled is returned when changing two-factor settings of a user without it
+	ErrTOTPNotEnabled modelError = "models: two-factor authentication is not enabled"
+)
+
+// RecoveryCode is a single-use code to sign in without the authenticator app.
+// Like session tokens only the HMAC of the code is stored
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"not null;index"`
+	CodeHash string `gorm:"not null;unique_index"`
+	UsedAt   *time.Time
+}
+
+type recoveryCodeDB interface {
+	// Replace deletes every recovery code of the user and stores codes instead
+	Replace(userID uint, codes []string) error
+
+	// Use marks an unused code of the user as used, returning ErrNotFound if there is none
+	Use(userID uint, code string) error
+
+	// Remaining counts the unused codes of the user
+	Remaining(userID uint) (int, error)
+	DeleteByUserID(userID uint) error
+}
+
+type recoveryCodeValidator struct {
+	recoveryCodeDB
+	keyring *hash.Keyring
+}
+
+type recoveryCodeGorm struct {
+	db *gorm.DB
+}
+
+var _ recoveryCodeDB = &recoveryCodeGorm{}
+
+func newRecoveryCodeValidator(db recoveryCodeDB, keyring *hash.Keyring) *recoveryCodeValidator {
+	return &recoveryCodeValidator{
+		recoveryCodeDB: db,
+		keyring:        keyring,
+	}
+}
+
+// Replace swaps the codes in a transaction, so the user is never left without any
+func (rcg *recoveryCodeGorm) Replace(userID uint, codeHashes []string) error {
+	return inTransaction(rcg.db, func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		for _, codeHash := range codeHashes {
+			rc := RecoveryCode{
+				UserID:   userID,
+				CodeHash: codeHash,
+			}
+			if err := tx.Create(&rc).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+func (rcv *recoveryCodeValidator) Replace(userID uint, codes []string) error {
+	if userID == 0 {
+		return ErrUserIDRequired
+	}
+
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = rcv.keyring.Hash(code)
+	}
+	return rcv.recoveryCodeDB.Replace(userID, hashes)
+}
+
+// Use marks the code as used with a conditional update, so two concurrent logins
+// can not both use the same code
+func (rcg *recoveryCodeGorm) Use(userID uint, codeHash string) error {
+	db := rcg.db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", time.Now())
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+// The code is hashed with the current key first, then with the previous ones
+func (rcv *recoveryCodeValidator) Use(userID uint, code string) error {
+	code = strings.TrimSpace(code)
+	if userID == 0 || code == "" {
+		return ErrNotFound
+	}
+
+	for _, codeHash := range rcv.keyring.HashAll(code) {
+		err := rcv.recoveryCodeDB.Use(userID, codeHash)
+		if err == ErrNotFound {
+			continue
+		}
+		return err
+	}
+	return ErrNotFound
+}
+
+// Remaining will count the codes of the user that were not used yet
+func (rcg *recoveryCodeGorm) Remaining(userID uint) (int, error) {
+	var n int
+	err := rcg.db.Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&n).Error
+	return n, err
+}
+
+// DeleteByUserID will delete every recovery code of the user
+func (rcg *recoveryCodeGorm) DeleteByUserID(userID uint) error {
+	return rcg.db.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+}
+func (rcv *recoveryCodeValidator) DeleteByUserID(userID uint) error {
+	if userID == 0 {
+		return ErrUserIDRequired
+	}
+
+	return rcv.recoveryCodeDB.DeleteByUserID(userID)
+}
+
+// EnrollTOTP starts two-factor setup, returning the secret to add to an authenticator app.
+// The secret is stored right away but only required once EnableTOTP confirmed the app
+// works, calling EnrollTOTP again before that returns the same secret
+func (us *userService) EnrollTOTP(user *User) (string, error) {
+	if user.TOTPEnabled {
+		return "", ErrTOTPEnabled
+	}
+	if user.TOTPSecretEncrypted != "" {
+		return us.uv.totpCipher.Decrypt(user.TOTPSecretEncrypted)
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	user.TOTPSecret = secret
+	if err := us.Update(user); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// EnableTOTP turns two-factor authentication on once code shows the app from EnrollTOTP
+// works, returning the recovery codes to show the user. Only their hashes are kept
+// If the code is wrong, this will return ErrTOTPInvalid
+func (us *userService) EnableTOTP(user *User, code string) ([]string, error) {
+	if user.TOTPEnabled {
+		return nil, ErrTOTPEnabled
+	}
+	if user.TOTPSecretEncrypted == "" {
+		return nil, ErrTOTPInvalid
+	}
+
+	ok, err := us.checkTOTP(user, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrTOTPInvalid
+	}
+
+	codes, err := us.newRecoveryCodes(user)
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPEnabled = true
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off, code can be from the app or a recovery code
+// If the code is wrong, this will return ErrTOTPInvalid
+// If the role of the user requires two-factor authentication, this will return ErrTOTPRequiredForRole
+func (us *userService) DisableTOTP(user *User, code string) error {
+	if !user.TOTPEnabled {
+		return ErrTOTPNotEnabled
+	}
+	if user.RequiresTOTP() {
+		return ErrTOTPRequiredForRole
+	}
+
+	ok, err := us.checkSecondFactor(user, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrTOTPInvalid
+	}
+
+	user.TOTPEnabled = false
+	user.TOTPSecretEncrypted = ""
+	if err := us.Update(user); err != nil {
+		return err
+	}
+	return us.recoveryCodes.DeleteByUserID(user.ID)
+}
+
+// RegenerateRecoveryCodes replaces every recovery code of the user, used or not
+// If the code is wrong, this will return ErrTOTPInvalid
+func (us *userService) RegenerateRecoveryCodes(user *User, code string) ([]string, error) {
+	if !user.TOTPEnabled {
+		return nil, ErrTOTPNotEnabled
+	}
+
+	ok, err := us.checkSecondFactor(user, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrTOTPInvalid
+	}
+
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	return us.newRecoveryCodes(user)
+}
+
+// RecoveryCodesLeft counts the recovery codes the user has not used yet
+func (us *userService) RecoveryCodesLeft(user *User) (int, error) {
+	return us.recoveryCodes.Remaining(user.ID)
+}
+
+// VerifyTOTP is the second step of a login after Authenticate returned ErrTOTPRequired.
+// Wrong codes count as failed logins like wrong passwords, so guessing codes locks the account too
+// If the code is wrong, this will return ErrTOTPInvalid
+// If the account is locked, this will return ErrAccountLocked
+func (us *userService) VerifyTOTP(user *User, code string) error {
+	return us.VerifyTOTPContext(context.Background(), user, code)
+}
+
+// VerifyTOTPContext is VerifyTOTP with the user saved using ctx
+func (us *userService) VerifyTOTPContext(ctx context.Context, user *User, code string) error {
+	if !user.TOTPEnabled {
+		return ErrTOTPNotEnabled
+	}
+
+	now := time.Now()
+	if user.Locked(now) {
+		return ErrAccountLocked
+	}
+
+	ok, err := us.checkSecondFactor(user, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := us.recordFailedLogin(ctx, user, now); err != nil {
+			return err
+		}
+		if user.Locked(now) {
+			return ErrAccountLocked
+		}
+		return ErrTOTPInvalid
+	}
+
+	user.FailedLogins = 0
+	user.LockedUntil = nil
+	return us.UpdateContext(ctx, user)
+}
+
+// LoginToken returns a short lived token for a user whose password was accepted, to carry
+// to the second step of the login. It is bound to the password hash, so a password reset
+// in between invalidates it
+func (us *userService) LoginToken(user *User) (string, error) {
+	return us.signUserToken(loginTokenPurpose, user, user.PasswordHash, loginTokenTTL)
+}
+
+// ByLoginToken looks up the user a token from LoginToken was issued to
+// If the token is malformed, expired or the password changed since, this will return ErrTokenInvalid
+func (us *userService) ByLoginToken(token string) (*User, error) {
+	user, err := us.parseUserToken(loginTokenPurpose, token, func(u *User) string { return u.PasswordHash })
+	if err != nil {
+		return nil, err
+	}
+	if !user.TOTPEnabled {
+		return nil, ErrTokenInvalid
+	}
+	return user, nil
+}
+
+// checkSecondFactor accepts a code from the app or an unused recovery code, which gets used up
+func (us *userService) checkSecondFactor(user *User, code string) (bool, error) {
+	ok, err := us.checkTOTP(user, code)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	err = us.recoveryCodes.Use(user.ID, code)
+	switch err {
+	case nil:
+		return true, nil
+	case ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// checkTOTP validates code against the secret of the user. Codes stay valid for a few
+// periods, so the step of the last accepted code is recorded right away with UseTOTPStep
+// and never accepted again, not even by a request checking the same code concurrently
+func (us *userService) checkTOTP(user *User, code string) (bool, error) {
+	secret, err := us.uv.totpCipher.Decrypt(user.TOTPSecretEncrypted)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok || step <= user.TOTPLastStep {
+		return false, nil
+	}
+	ok, err = us.UseTOTPStep(user.ID, step)
+	if err != nil || !ok {
+		return false, err
+	}
+	user.TOTPLastStep = step
+	return true, nil
+}
+
+// newRecoveryCodes generates recoveryCodeCount codes for the user, replacing the previous ones
+func (us *userService) newRecoveryCodes(user *User) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := rand.String(recoveryCodeBytes)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+	}
+	if err := us.recoveryCodes.Replace(user.ID, codes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// encryptTOTPSecret encrypts a new TOTP secret before it is stored
+func (uv *userValidator) encryptTOTPSecret(user *User) error {
+	if user.TOTPSecret == "" {
+		return nil
+	}
+	encrypted, err := uv.totpCipher.Encrypt(user.TOTPSecret)
+	if err != nil {
+		return err
+	}
+	user.TOTPSecretEncrypted = encrypted
+	user.TOTPSecret = ""
+	return nil
+}
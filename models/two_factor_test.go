@@ -0,0 +1,110 @@
+package models
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"ecommerce/totp"
+)
+
+// enableTOTP turns two-factor authentication on for the user with the code of the
+// previous step, and returns the secret and the current step
+func enableTOTP(t *testing.T, s *Services, user *User) (string, int64) {
+	t.Helper()
+
+	// the previous step must stay within totp.Skew until the test is done
+	next := time.Unix((totp.Step(time.Now())+1)*int64(totp.Period/time.Second), 0)
+	if left := time.Until(next); left < 5*time.Second {
+		time.Sleep(left)
+	}
+	step := totp.Step(time.Now())
+
+	secret, err := s.User.EnrollTOTP(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.User.EnableTOTP(user, totpCode(t, secret, step-1)); err != nil {
+		t.Fatal(err)
+	}
+	return secret, step
+}
+
+// totpCode returns the code of secret for the step
+func totpCode(t *testing.T, secret string, step int64) string {
+	t.Helper()
+
+	code, err := totp.Code(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestVerifyTOTPReplay(t *testing.T) {
+	eachStorage(t, func(t *testing.T, s *Services) {
+		user := createUser(t, s, "jon@example.com")
+		secret, step := enableTOTP(t, s, user)
+
+		tests := []struct {
+			name string
+			code string
+			want error
+		}{
+			{"code used to enable", totpCode(t, secret, step-1), ErrTOTPInvalid},
+			{"current code", totpCode(t, secret, step), nil},
+			{"current code again", totpCode(t, secret, step), ErrTOTPInvalid},
+		}
+		for _, tt := range tests {
+			// a fresh copy, like the user loaded by each login request
+			stored, err := s.User.ByID(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.User.VerifyTOTP(stored, tt.code); err != tt.want {
+				t.Fatalf("%s: got error %v, want %v", tt.name, err, tt.want)
+			}
+		}
+	})
+}
+
+func TestVerifyTOTPConcurrently(t *testing.T) {
+	eachStorage(t, func(t *testing.T, s *Services) {
+		user := createUser(t, s, "jon@example.com")
+		secret, step := enableTOTP(t, s, user)
+		code := totpCode(t, secret, step)
+
+		// both requests loaded the user before either checked the code
+		users := make([]*User, 2)
+		for i := range users {
+			stored, err := s.User.ByID(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			users[i] = stored
+		}
+
+		errs := make([]error, len(users))
+		var wg sync.WaitGroup
+		for i := range users {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = s.User.VerifyTOTP(users[i], code)
+			}(i)
+		}
+		wg.Wait()
+
+		accepted := 0
+		for _, err := range errs {
+			if err == nil {
+				accepted++
+			} else if err != ErrTOTPInvalid {
+				t.Fatalf("got error %v, want nil or ErrTOTPInvalid", err)
+			}
+		}
+		if accepted != 1 {
+			t.Fatalf("the same code was accepted %d times, want once", accepted)
+		}
+	})
+}
@@ -1,19 +1,27 @@
 package models
 
 import (
+	"context"
+	"ecommerce/encrypt"
 	"ecommerce/hash"
 	"ecommerce/rand"
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/postgres"
 	"golang.org/x/crypto/bcrypt"
 	"strings"
+	"time"
 )
 
 const (
-	hmacSecretKey = "6hMXiDnQoH8Ec7KQ"
-	userPwPepper = "6J53aQog5tQPaJPT"
+	// passwordMinLength is the MinLength of DefaultPasswordPolicy
+	passwordMinLength = 8
 
-	passwordMinLength = 4
+	// maxFailedLogins is how many wrong passwords in a row lock the account
+	maxFailedLogins = 5
+
+	// lockoutDuration is how long the first lockout lasts, every failed login
+	// after it doubles the duration up to maxLockoutDuration
+	lockoutDuration    = 15 * time.Minute
+	maxLockoutDuration = 24 * time.Hour
 )
 
 var (
@@ -23,8 +31,14 @@ var (
 	// ErrIdInvalid is returned when an invalid ID is provided to a method like Delete
 	ErrIdInvalid modelError = "models: ID provided was invalid"
 
-	// ErrPasswordIncorrect is returned when an invalid password is used when attempting to authenticate a user
-	ErrPasswordIncorrect modelError = "models: incorrect password provided"
+	// ErrCredentialsInvalid is returned by Authenticate for an unknown email, a wrong password
+	// or a locked account, the same error is used for all of them so it does not tell whether
+	// an account exists
+	ErrCredentialsInvalid modelError = "models: invalid email address or password, accounts are locked for a while after too many failed logins"
+
+	// ErrAccountLocked is returned by VerifyTOTP while the account is locked after too many
+	// failed logins. The password was right by then, so the account is known to exist
+	ErrAccountLocked modelError = "models: this account is temporarily locked after too many failed logins, try again later or reset your password"
 
 	// ErrEmailRequired is returned when a username is not provided when creating a user
 	ErrEmailRequired modelError = "models: username is required"
@@ -32,12 +46,15 @@ var (
 	// ErrEmailTaken is returned when a username already exists on database
 	ErrEmailTaken modelError = "models: email address is already taken"
 
-	// ErrPasswordTooShort is returned when a user tries to set a password that is lower
-	// than passwordMinLength const
+	// ErrPasswordTooShort is returned when a user tries to set a password shorter
+	// than the MinLength of the password policy
 	ErrPasswordTooShort modelError = "models: password is too short"
 
 	// ErrPasswordRequired is returned when a Create is attempted without a user password
 	ErrPasswordRequired modelError = "models: password is required"
+
+	// ErrTokenInvalid is returned when a password reset token is unknown or expired
+	ErrTokenInvalid modelError = "models: token provided is not valid or has expired"
 )
 
 // Public and Error wrap errors for display on the frontend
@@ -60,27 +77,60 @@ type UserDB interface {
 	ByEmail(email string) (*User, error)
 	ByRemember(token string) (*User, error)
 
+	// Methods for querying multiple users
+	All() ([]User, error)
+
 	// Methods for altering users
 	Create(user *User) error
 	Update(user *User) error
 	Delete(id uint) error
 
-	// Used to close a DB connection
-	Close() error
+	// Context variants of the methods above, their queries are cancelled once ctx
+	// is done, e.g. when the client of the request went away
+	ByIDContext(ctx context.Context, id uint) (*User, error)
+	ByEmailContext(ctx context.Context, email string) (*User, error)
+	ByRememberContext(ctx context.Context, token string) (*User, error)
+	CreateContext(ctx context.Context, user *User) error
+	UpdateContext(ctx context.Context, user *User) error
+	DeleteContext(ctx context.Context, id uint) error
+
+	// UseTOTPStep records step as the last TOTP step accepted for the user, reporting
+	// false when the recorded step is not older, e.g. the code was just used elsewhere.
+	// Update never changes the recorded step, only UseTOTPStep does
+	UseTOTPStep(userID uint, step int64) (bool, error)
 
-	// Migration helpers
-	AutoMigrate() error
-	DestructiveReset() error
+	// IncrementFailedLogins adds one to the failed logins of the user in a single
+	// statement, so concurrent failures are all counted, and returns the new count.
+	// LockUntil locks the user out until the provided time
+	IncrementFailedLogins(ctx context.Context, userID uint) (int, error)
+	LockUntil(ctx context.Context, userID uint, until time.Time) error
 }
 
 type User struct {
 	gorm.Model
 	Name			string
 	Email			string `gorm:"not null;unique_index"`
+	Role			string `gorm:"not null;default:'customer'"`
 	Password		string `gorm:"-"`
 	PasswordHash	string `gorm:"not null"`
-	Remember		string `gorm:"-"`
-	RememberHash	string `gorm:"not null;unique_index"`
+	EmailVerifiedAt	*time.Time
+	PepperVersion	int `gorm:"not null;default:0"`
+	FailedLogins	int `gorm:"not null;default:0"`
+	LockedUntil	*time.Time
+	TOTPSecret	string `gorm:"-"`
+	TOTPSecretEncrypted	string
+	TOTPEnabled	bool `gorm:"not null;default:false"`
+	TOTPLastStep	int64 `gorm:"not null;default:0"`
+}
+
+// Verified reports whether the user has confirmed their email address
+func (u *User) Verified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// Locked reports whether logins to the account are refused at the given time
+func (u *User) Locked(now time.Time) bool {
+	return u.LockedUntil != nil && now.Before(*u.LockedUntil)
 }
 
 type userGorm struct {
@@ -92,47 +142,118 @@ var _ UserService = &userService{}
 
 type userService struct {
 	UserDB
+	dummyHash     []byte
+	keyring       *hash.Keyring
+	uv            *userValidator
+	pwResetDB     pwResetDB
+	sessions      SessionDB
+	recoveryCodes recoveryCodeDB
+
+	// transaction runs fn with a userService whose queries share one transaction
+	transaction func(fn func(tx *userService) error) error
 }
 
 type userValidator struct {
 	UserDB
-	hmac hash.HMAC
+	keyring *hash.Keyring
+	peppers Peppers
+	policy  PasswordPolicy
+
+	totpCipher *encrypt.AESGCM
 }
 
 type userValFn func(*User) error
 
 type UserService interface {
 	Authenticate(email, password string) (*User, error)
+
+	// AuthenticateContext is Authenticate with its queries cancelled once ctx is done
+	AuthenticateContext(ctx context.Context, email, password string) (*User, error)
+
+	// InitiateReset starts a password reset for the user with the given email,
+	// returning the token to email to them
+	InitiateReset(email string) (string, error)
+
+	// CompleteReset sets a new password using a token from InitiateReset
+	// and signs the user out of every device
+	CompleteReset(token, newPw string) (*User, error)
+
+	// VerificationToken creates the token to email to the user to verify their address
+	VerificationToken(user *User) (string, error)
+
+	// VerifyEmail marks the email of the user the token was issued to as verified
+	VerifyEmail(token string) (*User, error)
+
+	// EnrollTOTP returns the secret for the authenticator app, EnableTOTP
+	// confirms it with a code and returns the recovery codes to show once
+	EnrollTOTP(user *User) (string, error)
+	EnableTOTP(user *User, code string) ([]string, error)
+	DisableTOTP(user *User, code string) error
+	RegenerateRecoveryCodes(user *User, code string) ([]string, error)
+	RecoveryCodesLeft(user *User) (int, error)
+
+	// VerifyTOTP finishes a login after Authenticate returned ErrTOTPRequired,
+	// LoginToken and ByLoginToken carry the user between the two steps
+	VerifyTOTP(user *User, code string) error
+	VerifyTOTPContext(ctx context.Context, user *User, code string) error
+	LoginToken(user *User) (string, error)
+	ByLoginToken(token string) (*User, error)
 	UserDB
 }
 
-func NewUserService(connectionInfo string) (UserService, error) {
-	ug, err := newUserGorm(connectionInfo)
+// NewUserService builds a UserService on top of the connection shared by Services.
+// The current pepper is appended to every new password before hashing, previous ones
+// are only used to check older hashes. keyring hashes session and reset tokens, the
+// same way SessionService does. policy decides which passwords are accepted and the
+// bcrypt cost they are hashed with. totpCipher encrypts the TOTP secrets at rest
+func NewUserService(db *gorm.DB, peppers Peppers, keyring *hash.Keyring, policy PasswordPolicy, totpCipher *encrypt.AESGCM) UserService {
+	dummyHash, err := newDummyHash(peppers, policy)
 	if err != nil {
-		return nil, err
+		panic(err)
 	}
+	return newUserGormService(db, peppers, keyring, policy, totpCipher, dummyHash)
+}
+
+func newUserGormService(db *gorm.DB, peppers Peppers, keyring *hash.Keyring, policy PasswordPolicy,
+	totpCipher *encrypt.AESGCM, dummyHash []byte) *userService {
+	return newUserService(&userGorm{db: db}, &pwResetGorm{db: db}, &sessionGorm{db: db},
+		&recoveryCodeGorm{db: db}, peppers, keyring, policy, totpCipher, dummyHash,
+		func(fn func(tx *userService) error) error {
+			return inTransaction(db, func(tx *gorm.DB) error {
+				return fn(newUserGormService(tx, peppers, keyring, policy, totpCipher, dummyHash))
+			})
+		})
+}
 
-	hmac := hash.NewHMAC(hmacSecretKey)
+// newDummyHash makes the hash compared against when the email is unknown, so a login
+// for a missing account takes as long as one with a wrong password
+func newDummyHash(peppers Peppers, policy PasswordPolicy) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte("dummy password"+peppers.Current().Secret), policy.Cost)
+}
 
+// newUserService builds a UserService on top of the given storage, the gorm one or
+// the in-memory one of WithMemory. dummyHash comes from newDummyHash
+func newUserService(ug UserDB, pwResets pwResetDB, sessions SessionDB, recoveryCodes recoveryCodeDB,
+	peppers Peppers, keyring *hash.Keyring, policy PasswordPolicy, totpCipher *encrypt.AESGCM,
+	dummyHash []byte, transaction func(fn func(tx *userService) error) error) *userService {
 	uv := &userValidator{
-		hmac:  hmac,
+		keyring: keyring,
+		peppers: peppers,
+		policy: policy,
+		totpCipher: totpCipher,
 		UserDB: ug,
 	}
 
 	return &userService{
 		UserDB: uv,
-	}, nil
-}
-
-func newUserGorm(connectionInfo string) (*userGorm, error) {
-	db, err := gorm.Open("postgres", connectionInfo)
-	if err != nil {
-		return nil, err
+		dummyHash: dummyHash,
+		keyring: keyring,
+		uv: uv,
+		pwResetDB: newPwResetValidator(pwResets, keyring),
+		sessions: newSessionValidator(sessions, keyring),
+		recoveryCodes: newRecoveryCodeValidator(recoveryCodes, keyring),
+		transaction: transaction,
 	}
-	db.LogMode(true)
-	return &userGorm{
-		db:	db,
-	}, nil
 }
 
 // ByID will look up a user with the provided ID
@@ -140,8 +261,11 @@ func newUserGorm(connectionInfo string) (*userGorm, error) {
 // If the user is not found, return ErrNotFound
 // If there is another error, return an error with more information
 func (ug *userGorm) ByID(id uint) (*User, error) {
+	return ug.ByIDContext(context.Background(), id)
+}
+func (ug *userGorm) ByIDContext(ctx context.Context, id uint) (*User, error) {
 	var user User
-	db := ug.db.Where("id = ?", id)
+	db := withContext(ug.db, ctx).Where("id = ?", id)
 	err := first(db, &user)
 	if err != nil {
 		return nil, err
@@ -154,12 +278,20 @@ func (ug *userGorm) ByID(id uint) (*User, error) {
 // If the user is not found, return ErrNotFound
 // If there is another error, return error with more information
 func (ug *userGorm) ByEmail(email string) (*User, error) {
+	return ug.ByEmailContext(context.Background(), email)
+}
+func (ug *userGorm) ByEmailContext(ctx context.Context, email string) (*User, error) {
 	var user User
-	db := ug.db.Where("email = ?", email)
+	// normalizeEmail lowercases emails in Go before they are saved or looked up,
+	// so the lookup does not depend on lower() of SQLite, which only folds ASCII
+	db := withContext(ug.db, ctx).Where("email = ?", email)
 	err := first(db, &user)
 	return &user, err
 }
 func (uv *userValidator) ByEmail(email string) (*User, error) {
+	return uv.ByEmailContext(context.Background(), email)
+}
+func (uv *userValidator) ByEmailContext(ctx context.Context, email string) (*User, error) {
 	user := User{
 		Email: email,
 	}
@@ -168,15 +300,22 @@ func (uv *userValidator) ByEmail(email string) (*User, error) {
 		return nil, err
 	}
 
-	return uv.UserDB.ByEmail(user.Email)
+	return uv.UserDB.ByEmailContext(ctx, user.Email)
 }
 
-// ByRemember looks up a user with the given remember token and returns that user.
-// This method will handle hashing the token
+// ByRemember looks up the user signed in with the given session token and returns that user.
+// This method will handle hashing the token, trying the current key first and then the
+// previous ones, expired sessions are ignored
 // Errors are the same as ByEmail
-func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
+func (ug *userGorm) ByRemember(tokenHash string) (*User, error) {
+	return ug.ByRememberContext(context.Background(), tokenHash)
+}
+func (ug *userGorm) ByRememberContext(ctx context.Context, tokenHash string) (*User, error) {
 	var user User
-	err := first(ug.db.Where("remember_hash = ?", rememberHash), &user)
+	db := withContext(ug.db, ctx).Select("users.*").
+		Joins("JOIN sessions ON sessions.user_id = users.id AND sessions.deleted_at IS NULL").
+		Where("sessions.token_hash = ? AND sessions.expires_at > ?", tokenHash, time.Now())
+	err := first(db, &user)
 	if err != nil {
 		return nil, err
 	}
@@ -184,65 +323,110 @@ func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
 	return &user, nil
 }
 func (uv *userValidator) ByRemember(token string) (*User, error) {
-	user := User{
-		Remember: token,
+	return uv.ByRememberContext(context.Background(), token)
+}
+func (uv *userValidator) ByRememberContext(ctx context.Context, token string) (*User, error) {
+	if token == "" {
+		return nil, ErrNotFound
 	}
 
-	if err := runUserValFns(&user, uv.hmacRemember); err != nil {
-		return nil, err
+	for _, tokenHash := range uv.keyring.HashAll(token) {
+		user, err := uv.UserDB.ByRememberContext(ctx, tokenHash)
+		if err == ErrNotFound {
+			continue
+		}
+		return user, err
 	}
+	return nil, ErrNotFound
+}
 
-	return uv.UserDB.ByRemember(user.RememberHash)
+// All returns every user ordered by ID
+func (ug *userGorm) All() ([]User, error) {
+	var users []User
+	err := ug.db.Order("id").Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
 }
 
 // Update will update the provided user with all of the data in the provided user object
 func (ug *userGorm) Update(user *User) error {
-	return ug.db.Save(user).Error
+	return ug.UpdateContext(context.Background(), user)
+}
+func (ug *userGorm) UpdateContext(ctx context.Context, user *User) error {
+	return withContext(ug.db, ctx).Omit("totp_last_step").Save(user).Error
 }
 func (uv *userValidator) Update(user *User) error {
+	return uv.UpdateContext(context.Background(), user)
+}
+func (uv *userValidator) UpdateContext(ctx context.Context, user *User) error {
+	// unlike Create no password is required: most updates, like counting failed logins,
+	// verifying the email or changing the role, keep the stored hash, which
+	// passwordHashRequired still checks. A new password is validated before it is hashed
 	if err := runUserValFns(user,
-		uv.passwordRequired,
 		uv.passwordMinLength,
+		uv.passwordMaxLength,
+		uv.passwordNotEmail,
+		uv.passwordNotBreached,
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.hmacRemember,
+		uv.encryptTOTPSecret,
 		uv.normalizeEmail,
 		uv.requireEmail,
-		uv.emailIsAvailable); err != nil {
+		uv.emailIsAvailable(ctx),
+		uv.setRoleIfUnset,
+		uv.roleValid); err != nil {
 		return err
 	}
 
-	return uv.UserDB.Update(user)
+	return uv.UserDB.UpdateContext(ctx, user)
 }
 
 // Create will create the provided user and backfill data like the ID, CreatedAt, UpdatedAt fields
 func (ug *userGorm) Create(user *User) error {
-	return ug.db.Create(user).Error
+	return ug.CreateContext(context.Background(), user)
+}
+func (ug *userGorm) CreateContext(ctx context.Context, user *User) error {
+	return withContext(ug.db, ctx).Create(user).Error
 }
 func (uv *userValidator) Create(user *User) error {
+	return uv.CreateContext(context.Background(), user)
+}
+func (uv *userValidator) CreateContext(ctx context.Context, user *User) error {
 	err := runUserValFns(user,
 		uv.passwordRequired,
 		uv.passwordMinLength,
+		uv.passwordMaxLength,
+		uv.passwordNotEmail,
+		uv.passwordNotBreached,
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.setRememberIfUnset,
-		uv.hmacRemember,
+		uv.encryptTOTPSecret,
 		uv.normalizeEmail,
 		uv.requireEmail,
-		uv.emailIsAvailable)
+		uv.emailIsAvailable(ctx),
+		uv.setRoleIfUnset,
+		uv.roleValid)
 	if err != nil {
 		return err
 	}
 
-	return uv.UserDB.Create(user)
+	return uv.UserDB.CreateContext(ctx, user)
 }
 
 // Delete will delete the user with the provided ID
 func (ug *userGorm) Delete(id uint) error {
+	return ug.DeleteContext(context.Background(), id)
+}
+func (ug *userGorm) DeleteContext(ctx context.Context, id uint) error {
 	user := User{Model: gorm.Model{ID:id}}
-	return ug.db.Delete(&user).Error
+	return withContext(ug.db, ctx).Delete(&user).Error
 }
 func (uv *userValidator) Delete(id uint) error {
+	return uv.DeleteContext(context.Background(), id)
+}
+func (uv *userValidator) DeleteContext(ctx context.Context, id uint) error {
 	var user User
 	user.ID = id
 	err := runUserValFns(&user, uv.idGreaterThan(0))
@@ -250,57 +434,247 @@ func (uv *userValidator) Delete(id uint) error {
 		return err
 	}
 
-	return uv.UserDB.Delete(id)
+	return uv.UserDB.DeleteContext(ctx, id)
 }
 
-// DestructiveReset drops the user table and rebuilds it
-func (ug *userGorm) DestructiveReset() error {
-	err := ug.db.DropTableIfExists(&User{}).Error
-	if err != nil {
-		return err
+// UseTOTPStep is a conditional update, the row is only changed while its step is
+// older, so of two logins racing with the same code only one changes it
+func (ug *userGorm) UseTOTPStep(userID uint, step int64) (bool, error) {
+	res := ug.db.Model(&User{}).
+		Where("id = ? AND totp_last_step < ?", userID, step).
+		UpdateColumn("totp_last_step", step)
+	if res.Error != nil {
+		return false, res.Error
 	}
-	return ug.AutoMigrate()
+	return res.RowsAffected == 1, nil
 }
 
-// AutoMigrate will attempt to automatically migrate the users table
-func (ug *userGorm) AutoMigrate() error {
-	if err := ug.db.AutoMigrate(&User{}).Error; err != nil {
-		return err
+// IncrementFailedLogins reads the count back after the update, in a transaction the
+// updated row stays locked so the count is the one this update made
+func (ug *userGorm) IncrementFailedLogins(ctx context.Context, userID uint) (int, error) {
+	db := withContext(ug.db, ctx)
+	res := db.Model(&User{}).Where("id = ?", userID).
+		UpdateColumn("failed_logins", gorm.Expr("failed_logins + ?", 1))
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return 0, ErrNotFound
 	}
-	return nil
-}
 
+	var user User
+	if err := first(db.Select("failed_logins").Where("id = ?", userID), &user); err != nil {
+		return 0, err
+	}
+	return user.FailedLogins, nil
+}
 
-// Closes the UserService database connection
-func (ug *userGorm) Close() error {
-	return ug.db.Close()
+// LockUntil only changes locked_until, so it can not undo concurrent updates
+func (ug *userGorm) LockUntil(ctx context.Context, userID uint, until time.Time) error {
+	return withContext(ug.db, ctx).Model(&User{}).Where("id = ?", userID).
+		UpdateColumn("locked_until", until).Error
 }
 
 // Authenticate can be used to authenticate a user with the provided username and password
-// If the username provided is invalid, this will return ErrNotFound
-// If the password is invalid, this will return ErrPasswordIncorrect
+// If the username or the password is invalid, or the account is locked, this will return
+// ErrCredentialsInvalid. The password is checked either way, so the response time does not
+// tell a locked account from an unknown email or a wrong password
 // If the email and password are both valid, this will return user, nil
+// If the account also has two-factor authentication, this will return user, ErrTOTPRequired
+// instead and the login is only done once VerifyTOTP accepts a code
 // Otherwise if another error is encountered this will return nil, error
+// Every wrong password is counted on the user, maxFailedLogins in a row lock the account
 func (us *userService) Authenticate(email, password string) (*User, error) {
-	foundUser, err := us.ByEmail(email)
+	return us.AuthenticateContext(context.Background(), email, password)
+}
+func (us *userService) AuthenticateContext(ctx context.Context, email, password string) (*User, error) {
+	foundUser, err := us.ByEmailContext(ctx, email)
+	if err == ErrNotFound {
+		bcrypt.CompareHashAndPassword(us.dummyHash, []byte(password + us.uv.peppers.Current().Secret))
+		return nil, ErrCredentialsInvalid
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword(
-		[]byte(foundUser.PasswordHash),
-		[]byte(password + userPwPepper))
+	now := time.Now()
+	locked := foundUser.Locked(now)
+
+	// the pepper of the hash is tried first, hashes without pepper version try
+	// every pepper. A retired pepper leaves no candidate: only a reset helps then
+	peppers := us.uv.peppers.candidates(foundUser.PepperVersion)
+	if len(peppers) == 0 {
+		bcrypt.CompareHashAndPassword(us.dummyHash, []byte(password + us.uv.peppers.Current().Secret))
+		return nil, ErrCredentialsInvalid
+	}
+	for _, pepper := range peppers {
+		err = bcrypt.CompareHashAndPassword(
+			[]byte(foundUser.PasswordHash),
+			[]byte(password + pepper.Secret))
+		if err != bcrypt.ErrMismatchedHashAndPassword {
+			break
+		}
+	}
+
+	// failures are not counted while locked, or the lockout would keep growing
+	if locked {
+		return nil, ErrCredentialsInvalid
+	}
 
 	switch err {
 	case nil:
+		// with a second factor the failures are only forgiven by VerifyTOTP,
+		// otherwise a known password would allow unlimited guesses of the code
+		changed := false
+		if !foundUser.TOTPEnabled {
+			changed = foundUser.FailedLogins > 0 || foundUser.LockedUntil != nil
+			foundUser.FailedLogins = 0
+			foundUser.LockedUntil = nil
+		}
+
+		// the plaintext is only known now, so this is the one chance to move the
+		// hash to the current cost and pepper. The policy is skipped on purpose,
+		// users are not locked out when it becomes stricter
+		if us.uv.needsRehash(foundUser) {
+			foundUser.Password = password
+			if err := runUserValFns(foundUser, us.uv.bcryptPassword); err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+
+		if changed {
+			if err := us.UpdateContext(ctx, foundUser); err != nil {
+				return nil, err
+			}
+		}
+		if foundUser.TOTPEnabled {
+			return foundUser, ErrTOTPRequired
+		}
 		return foundUser, nil
 	case bcrypt.ErrMismatchedHashAndPassword:
-		return nil, ErrPasswordIncorrect
+		if err := us.recordFailedLogin(ctx, foundUser, now); err != nil {
+			return nil, err
+		}
+		return nil, ErrCredentialsInvalid
 	default:
 		return nil, err
 	}
 }
 
+// recordFailedLogin counts a wrong password and locks the account once there were
+// maxFailedLogins in a row, each failure past that doubles the lockout. The count is
+// incremented in the database rather than saved from user, so wrong passwords tried
+// concurrently can not overwrite each other's count
+func (us *userService) recordFailedLogin(ctx context.Context, user *User, now time.Time) error {
+	return us.transaction(func(tx *userService) error {
+		failed, err := tx.IncrementFailedLogins(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		user.FailedLogins = failed
+		if failed < maxFailedLogins {
+			return nil
+		}
+
+		lockout := lockoutDuration
+		for i := maxFailedLogins; i < failed && lockout < maxLockoutDuration; i++ {
+			lockout *= 2
+		}
+		if lockout > maxLockoutDuration {
+			lockout = maxLockoutDuration
+		}
+		until := now.Add(lockout)
+		user.LockedUntil = &until
+		return tx.LockUntil(ctx, user.ID, until)
+	})
+}
+
+// InitiateReset creates a password reset for the user with the provided email,
+// deleting the resets the user had before so only the newest link works
+// If the email is unknown, this will return ErrNotFound. A token is made and hashed
+// anyway, so the response time does not tell whether the email belongs to a user
+// Otherwise it returns the token to send to the user
+func (us *userService) InitiateReset(email string) (string, error) {
+	user, err := us.ByEmail(email)
+	if err == ErrNotFound {
+		token, err := rand.String(pwResetTokenBytes)
+		if err != nil {
+			return "", err
+		}
+		us.keyring.Hash(token)
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	pwr := PasswordReset{
+		UserID: user.ID,
+	}
+	err = us.transaction(func(tx *userService) error {
+		if err := tx.pwResetDB.DeleteByUserID(user.ID); err != nil {
+			return err
+		}
+		return tx.pwResetDB.Create(&pwr)
+	})
+	if err != nil {
+		return "", err
+	}
+	return pwr.Token, nil
+}
+
+// CompleteReset sets newPw as the password of the user the token was issued to.
+// The token can only be used once and every session of the user is deleted,
+// signing out anyone who might have known the old password. Everything runs in
+// one transaction that deletes the reset first, so of two concurrent resets with
+// the same token only one can change the password
+// If the token is unknown, expired or already used, this will return ErrTokenInvalid
+func (us *userService) CompleteReset(token, newPw string) (*User, error) {
+	var user *User
+	err := us.transaction(func(tx *userService) error {
+		pwr, err := tx.pwResetDB.ByToken(token)
+		if err != nil {
+			return err
+		}
+		if err := tx.pwResetDB.Delete(pwr.ID); err != nil {
+			return err
+		}
+
+		user, err = tx.ByID(pwr.UserID)
+		if err != nil {
+			return err
+		}
+
+		// proving access to the email address is enough to lift a lockout
+		user.Password = newPw
+		user.FailedLogins = 0
+		user.LockedUntil = nil
+		err = runUserValFns(user,
+			tx.uv.passwordRequired,
+			tx.uv.passwordMinLength,
+			tx.uv.passwordMaxLength,
+			tx.uv.passwordNotEmail,
+			tx.uv.passwordNotBreached,
+			tx.uv.bcryptPassword)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Update(user); err != nil {
+			return err
+		}
+		return tx.sessions.DeleteByUserID(user.ID)
+	})
+	if err == ErrNotFound {
+		return nil, ErrTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
 // first will query using the provided gorm.DB and it will get the first
 // item returned and place it into dst. if nothing is found in the query
 // it will return ErrNotFound
@@ -312,18 +686,20 @@ func first (db *gorm.DB, dst interface{}) error {
 	return err
 }
 
-// bcryptPassword will hash a user's password with an app-wide
-// pepper and bcrypt, which salts
+// bcryptPassword will hash a user's password with the current app-wide
+// pepper and bcrypt, which salts, at the cost of the password policy
 func (uv *userValidator) bcryptPassword(user *User) error {
 	if user.Password == "" {
 		return nil
 	}
-	pwBytes := []byte(user.Password + userPwPepper)
-	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes, bcrypt.DefaultCost)
+	pepper := uv.peppers.Current()
+	pwBytes := []byte(user.Password + pepper.Secret)
+	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes, uv.policy.Cost)
 	if err != nil {
 		return err
 	}
 	user.PasswordHash = string(hashedBytes)
+	user.PepperVersion = pepper.Version
 	user.Password = ""
 	return nil
 }
@@ -339,29 +715,6 @@ func runUserValFns(user *User, functions ...userValFn) error {
 	return nil
 }
 
-// hmacRemember is a validation function that will check to see if remember token is present
-// and if so will hash using HMAC
-func (uv *userValidator) hmacRemember(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	user.RememberHash = uv.hmac.Hash(user.Remember)
-	return nil
-}
-
-// setRememberIfUnset will prevent a user being saved on the database without a remember token
-func (uv *userValidator) setRememberIfUnset(user *User) error {
-	if user.Remember != "" {
-		return nil
-	}
-	token, err := rand.RememberToken()
-	if err != nil {
-		return err
-	}
-	user.Remember = token
-	return nil
-}
-
 // idGreaterThan will ensure a valid ID for delete
 func (uv *userValidator) idGreaterThan(n uint) userValFn {
 	return userValFn(func(user *User) error {
@@ -392,29 +745,32 @@ func (uv *userValidator) requireEmail(user *User) error {
 // if user is not found, return nil continuing the chain
 // if query fails for some reason, return error
 // if the user.ID provided is the same as the user.ID of the queried object, that means this is taken so return ErrEmailTaken
-func (uv *userValidator) emailIsAvailable(user *User) error {
-	existing, err := uv.ByEmail(user.Email)
-	if err == ErrNotFound {
-		return nil
-	}
+// The query is made with ctx
+func (uv *userValidator) emailIsAvailable(ctx context.Context) userValFn {
+	return userValFn(func(user *User) error {
+		existing, err := uv.ByEmailContext(ctx, user.Email)
+		if err == ErrNotFound {
+			return nil
+		}
 
-	if err != nil {
-		return err
-	}
+		if err != nil {
+			return err
+		}
 
-	if user.ID != existing.ID {
-		return ErrEmailTaken
-	}
+		if user.ID != existing.ID {
+			return ErrEmailTaken
+		}
 
-	return nil
+		return nil
+	})
 }
 
-// passwordMinLength will make sure password meets minimum length
+// passwordMinLength will make sure password meets the minimum length of the policy
 func (uv *userValidator) passwordMinLength(user *User) error {
 	if user.Password == "" {
 		return nil
 	}
-	if len(user.Password) < 4 {
+	if len(user.Password) < uv.policy.MinLength {
 		return ErrPasswordTooShort
 	}
 
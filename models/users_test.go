@@ -0,0 +1,41 @@
+package models
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestAuthenticateLocksOut(t *testing.T) {
+	eachStorage(t, func(t *testing.T, s *Services) {
+		user := createUser(t, s, "jon@example.com")
+
+		// every wrong password counts, even when they are tried at the same time
+		var wg sync.WaitGroup
+		errs := make([]error, maxFailedLogins)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = s.User.Authenticate("jon@example.com", "wrong password")
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != ErrCredentialsInvalid {
+				t.Fatalf("got error %v, want ErrCredentialsInvalid", err)
+			}
+		}
+
+		locked, err := s.User.ByID(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked.FailedLogins != maxFailedLogins || locked.LockedUntil == nil {
+			t.Fatalf("got %d failed logins and lockout %v, want %d and a lockout",
+				locked.FailedLogins, locked.LockedUntil, maxFailedLogins)
+		}
+		if _, err := s.User.Authenticate("jon@example.com", "correct horse battery"); err != ErrCredentialsInvalid {
+			t.Fatalf("got error %v with the right password while locked, want ErrCredentialsInvalid", err)
+		}
+	})
+}
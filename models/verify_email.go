@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	// verifyTokenTTL is how long an email verification link stays valid
+	verifyTokenTTL = 72 * time.Hour
+
+	verifyTokenPurpose = "verify-email"
+)
+
+// ErrEmailNotVerified is returned when an unverified account tries something that needs a verified email
+var ErrEmailNotVerified modelError = "models: please verify your email address first, use the link we emailed you or ask for a new one"
+
+// VerificationToken returns a signed token proving the user received an email at their
+// current address. Nothing is stored, the signature covers the email so changing the
+// address invalidates older tokens
+func (us *userService) VerificationToken(user *User) (string, error) {
+	return us.signUserToken(verifyTokenPurpose, user, user.Email, verifyTokenTTL)
+}
+
+// VerifyEmail checks a token from VerificationToken and marks the email of its user as verified
+// If the token is malformed, expired or not signed for the user's current email,
+// this will return ErrTokenInvalid
+func (us *userService) VerifyEmail(token string) (*User, error) {
+	user, err := us.parseUserToken(verifyTokenPurpose, token, func(u *User) string { return u.Email })
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Verified() {
+		return user, nil
+	}
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
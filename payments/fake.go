@@ -0,0 +1,122 @@
+package payments
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Payment sources understood by Fake. Any other non empty source is accepted like FakeSourceOK
+const (
+	FakeSourceOK       = "tok_ok"
+	FakeSourceDeclined = "tok_declined"
+)
+
+// Fake is a fully local Gateway for development and tests.
+// Charges are kept in memory and no money ever moves
+type Fake struct {
+	Verifier
+
+	mu      sync.Mutex
+	charges map[string]*Charge
+	nextID  int
+}
+
+var _ Gateway = &Fake{}
+
+// NewFake creates a Fake gateway, webhooks are signed and verified with webhookSecret
+func NewFake(webhookSecret string) *Fake {
+	return &Fake{
+		Verifier: NewVerifier(webhookSecret),
+		charges:  make(map[string]*Charge),
+	}
+}
+
+// Authorize holds amount on the source, FakeSourceDeclined and empty sources are declined
+func (f *Fake) Authorize(amount int, source string) (*Charge, error) {
+	if amount <= 0 {
+		return nil, ErrAmountInvalid
+	}
+	if source == "" || source == FakeSourceDeclined {
+		return nil, ErrCardDeclined
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nextID++
+	charge := &Charge{
+		ID:     fmt.Sprintf("fake_ch_%d", f.nextID),
+		Status: StatusAuthorized,
+		Amount: amount,
+	}
+	f.charges[charge.ID] = charge
+
+	c := *charge
+	return &c, nil
+}
+
+// Capture takes amount from an authorized charge
+func (f *Fake) Capture(chargeID string, amount int) (*Charge, error) {
+	return f.update(chargeID, func(charge *Charge) error {
+		if charge.Status != StatusAuthorized {
+			return ErrChargeState
+		}
+		if amount <= 0 || amount > charge.Amount {
+			return ErrAmountInvalid
+		}
+		charge.Captured = amount
+		charge.Status = StatusCaptured
+		return nil
+	})
+}
+
+// Void releases an authorized charge
+func (f *Fake) Void(chargeID string) (*Charge, error) {
+	return f.update(chargeID, func(charge *Charge) error {
+		if charge.Status != StatusAuthorized {
+			return ErrChargeState
+		}
+		charge.Status = StatusVoided
+		return nil
+	})
+}
+
+// Refund gives back amount from a captured charge, once the whole
+// captured amount is refunded the charge becomes refunded
+func (f *Fake) Refund(chargeID string, amount int) (*Charge, error) {
+	return f.update(chargeID, func(charge *Charge) error {
+		if charge.Status != StatusCaptured {
+			return ErrChargeState
+		}
+		if amount <= 0 || charge.Refunded+amount > charge.Captured {
+			return ErrAmountInvalid
+		}
+		charge.Refunded += amount
+		if charge.Refunded == charge.Captured {
+			charge.Status = StatusRefunded
+		}
+		return nil
+	})
+}
+
+// VerifyWebhook checks payloads signed with Fake.Sign
+func (f *Fake) VerifyWebhook(payload []byte, signature string) (*Event, error) {
+	return f.Verify(payload, signature)
+}
+
+// update runs fn on the stored charge while holding the lock and returns a copy of the result
+func (f *Fake) update(chargeID string, fn func(*Charge) error) (*Charge, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	charge, ok := f.charges[chargeID]
+	if !ok {
+		return nil, ErrChargeNotFound
+	}
+	if err := fn(charge); err != nil {
+		return nil, err
+	}
+
+	c := *charge
+	return &c, nil
+}
@@ -0,0 +1,144 @@
+package payments
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"ecommerce/hash"
+)
+
+// Charge statuses
+const (
+	StatusAuthorized = "authorized"
+	StatusCaptured   = "captured"
+	StatusVoided     = "voided"
+	StatusRefunded   = "refunded"
+)
+
+var (
+	// ErrCardDeclined is returned when the payment source is declined during Authorize
+	ErrCardDeclined paymentError = "payments: your card was declined"
+
+	// ErrChargeNotFound is returned when a charge ID is unknown to the gateway
+	ErrChargeNotFound paymentError = "payments: charge not found"
+
+	// ErrAmountInvalid is returned when authorizing, capturing or refunding
+	// zero, a negative amount, or more than what is available on the charge
+	ErrAmountInvalid paymentError = "payments: amount is not valid for this charge"
+
+	// ErrChargeState is returned when an operation is not allowed in the charge's
+	// current status, e.g. refunding a charge that was never captured
+	ErrChargeState paymentError = "payments: charge cannot be changed in its current state"
+
+	// ErrSignatureInvalid is returned when a webhook signature does not match its payload
+	ErrSignatureInvalid paymentError = "payments: webhook signature is invalid"
+
+	// ErrEventExpired is returned when a signed webhook event was not created within
+	// WebhookTolerance of now, e.g. when an old payload is sent again
+	ErrEventExpired paymentError = "payments: webhook event is too old or too far in the future"
+)
+
+// paymentError works like models.modelError so messages can be displayed with views.Data.SetAlert
+type paymentError string
+
+func (e paymentError) Error() string {
+	return string(e)
+}
+
+func (e paymentError) Public() string {
+	s := strings.Replace(string(e), "payments: ", "", 1)
+	split := strings.Split(s, " ")
+	split[0] = strings.Title(split[0])
+	return strings.Join(split, " ")
+}
+
+// Charge is a payment held or taken by the gateway. Amounts are in cents
+type Charge struct {
+	ID       string
+	Status   string
+	Amount   int
+	Captured int
+	Refunded int
+}
+
+// Event types sent to the webhook
+const (
+	// EventChargeRefunded is sent when a charge was refunded at the gateway, e.g. from its dashboard
+	EventChargeRefunded = "charge.refunded"
+)
+
+// SignatureHeader is the header carrying the signature of a webhook payload
+const SignatureHeader = "X-Payments-Signature"
+
+// WebhookTolerance is how far the creation time of a webhook event may be from now.
+// The time is part of the signed payload, so a captured request can only be
+// replayed within this window
+const WebhookTolerance = 5 * time.Minute
+
+// Event is a callback sent by the gateway to notify about changes to a charge.
+// Created is the unix time the gateway sent it at
+type Event struct {
+	Type     string `json:"type"`
+	ChargeID string `json:"charge_id"`
+	Created  int64  `json:"created"`
+}
+
+// Gateway is implemented by every payment provider
+type Gateway interface {
+	// Authorize places a hold of amount on the payment source, without taking the money yet
+	Authorize(amount int, source string) (*Charge, error)
+
+	// Capture takes up to the authorized amount of a charge
+	Capture(chargeID string, amount int) (*Charge, error)
+
+	// Void releases an authorized charge that was not captured
+	Void(chargeID string) (*Charge, error)
+
+	// Refund gives back up to the captured amount of a charge
+	Refund(chargeID string, amount int) (*Charge, error)
+
+	// VerifyWebhook checks the signature of a webhook payload and decodes its event.
+	// Returns ErrSignatureInvalid if the payload cannot be trusted and ErrEventExpired
+	// if the event was not created within WebhookTolerance
+	VerifyWebhook(payload []byte, signature string) (*Event, error)
+}
+
+// Verifier signs and verifies webhook payloads with a secret shared with the gateway
+type Verifier struct {
+	hmac hash.HMAC
+}
+
+// NewVerifier creates a Verifier using the webhook secret shared with the gateway
+func NewVerifier(secret string) Verifier {
+	return Verifier{
+		hmac: hash.NewHMAC(secret),
+	}
+}
+
+// Sign returns the signature the gateway is expected to send along with the payload
+func (v Verifier) Sign(payload []byte) string {
+	return v.hmac.Hash(string(payload))
+}
+
+// Verify checks the signature in constant time, decodes the event in the payload and
+// makes sure it was created within WebhookTolerance
+func (v Verifier) Verify(payload []byte, signature string) (*Event, error) {
+	return v.verifyAt(payload, signature, time.Now())
+}
+
+func (v Verifier) verifyAt(payload []byte, signature string, now time.Time) (*Event, error) {
+	if !v.hmac.Equal(string(payload), signature) {
+		return nil, ErrSignatureInvalid
+	}
+
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	age := now.Sub(time.Unix(event.Created, 0))
+	if age > WebhookTolerance || age < -WebhookTolerance {
+		return nil, ErrEventExpired
+	}
+	return &event, nil
+}
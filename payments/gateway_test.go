@@ -0,0 +1,41 @@
+package payments
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	v := NewVerifier("secret")
+	now := time.Now()
+	payload := func(created time.Time) []byte {
+		return []byte(fmt.Sprintf(`{"type":%q,"charge_id":"fake_ch_1","created":%d}`,
+			EventChargeRefunded, created.Unix()))
+	}
+
+	tests := []struct {
+		name      string
+		payload   []byte
+		signature string
+		want      error
+	}{
+		{"signed now", payload(now), v.Sign(payload(now)), nil},
+		{"signed within tolerance", payload(now.Add(-time.Minute)), v.Sign(payload(now.Add(-time.Minute))), nil},
+		{"wrong signature", payload(now), NewVerifier("other").Sign(payload(now)), ErrSignatureInvalid},
+		{"replayed later", payload(now.Add(-time.Hour)), v.Sign(payload(now.Add(-time.Hour))), ErrEventExpired},
+		{"from the future", payload(now.Add(time.Hour)), v.Sign(payload(now.Add(time.Hour))), ErrEventExpired},
+		{"without time", []byte(`{"type":"charge.refunded"}`), v.Sign([]byte(`{"type":"charge.refunded"}`)), ErrEventExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, err := v.verifyAt(tt.payload, tt.signature, now)
+			if err != tt.want {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if err == nil && event.ChargeID != "fake_ch_1" {
+				t.Fatalf("got charge ID %q, want fake_ch_1", event.ChargeID)
+			}
+		})
+	}
+}
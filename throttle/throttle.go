@@ -0,0 +1,105 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter slows down repeated failures of the same key, e.g. login attempts from one IP.
+// The first Free failures cost nothing, after that every failure doubles the wait before
+// the next attempt, starting at Base and never above Max. Failures are forgotten once
+// Max has passed since the last one
+type Limiter struct {
+	Free int
+	Base time.Duration
+	Max  time.Duration
+
+	mu        sync.Mutex
+	failures  map[string]*failures
+	lastPrune time.Time
+}
+
+type failures struct {
+	n    int
+	last time.Time
+}
+
+// NewLimiter creates a Limiter, see Limiter for the meaning of the arguments
+func NewLimiter(free int, base, max time.Duration) *Limiter {
+	return &Limiter{
+		Free:     free,
+		Base:     base,
+		Max:      max,
+		failures: make(map[string]*failures),
+	}
+}
+
+// Wait returns how long key has to wait before its next attempt, zero if it can try now
+func (l *Limiter) Wait(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.failures[key]
+	if !ok {
+		return 0
+	}
+	wait := time.Until(f.last.Add(l.backoff(f.n)))
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// Fail records a failed attempt of key
+func (l *Limiter) Fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	f, ok := l.failures[key]
+	if !ok {
+		f = &failures{}
+		l.failures[key] = f
+	}
+	f.n++
+	f.last = now
+}
+
+// Reset forgets the failures of key
+func (l *Limiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.failures, key)
+}
+
+// backoff is the wait after n failures
+func (l *Limiter) backoff(n int) time.Duration {
+	if n < l.Free {
+		return 0
+	}
+	wait := l.Base
+	for i := l.Free; i < n && wait < l.Max; i++ {
+		wait *= 2
+	}
+	if wait > l.Max {
+		return l.Max
+	}
+	return wait
+}
+
+// prune drops failures older than Max so the map does not grow forever,
+// it only scans the map once every Max. l.mu must be held
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.Max {
+		return
+	}
+	l.lastPrune = now
+	for key, f := range l.failures {
+		if now.Sub(f.last) > l.Max {
+			delete(l.failures, key)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	l := NewLimiter(3, time.Second, 10*time.Second)
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{6, 8 * time.Second},
+		{7, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := l.backoff(tt.failures); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(2, time.Minute, time.Hour)
+
+	l.Fail("1.2.3.4")
+	if wait := l.Wait("1.2.3.4"); wait != 0 {
+		t.Fatalf("got a wait of %v after a free failure, want none", wait)
+	}
+	l.Fail("1.2.3.4")
+	if wait := l.Wait("1.2.3.4"); wait <= 0 || wait > time.Minute {
+		t.Fatalf("got a wait of %v once the free failures are used, want up to a minute", wait)
+	}
+	if wait := l.Wait("5.6.7.8"); wait != 0 {
+		t.Fatalf("got a wait of %v for another key, want none", wait)
+	}
+
+	l.Reset("1.2.3.4")
+	if wait := l.Wait("1.2.3.4"); wait != 0 {
+		t.Fatalf("got a wait of %v after Reset, want none", wait)
+	}
+}
@@ -1,6 +1,9 @@
 package views
 
-import "log"
+import (
+	"ecommerce/models"
+	"log"
+)
 
 const (
 	AlertLvlError	= "danger"
@@ -15,8 +18,10 @@ const (
 
 // Data is the top level structure that views expect data to come in through
 type Data struct {
-	Alert *Alert
-	Yield interface{}
+	Alert     *Alert
+	User      *models.User
+	CSRFToken string
+	Yield     interface{}
 }
 
 // Alert is used to render Boostrap alert messages in templates
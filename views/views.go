@@ -2,10 +2,15 @@ package views
 
 import (
 	"bytes"
+	"ecommerce/context"
+	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"net/http"
 	"path/filepath"
+
+	"github.com/gorilla/csrf"
 )
 
 var (
@@ -14,24 +19,60 @@ var (
 	TemplateExt string = ".gohtml"
 )
 
+// funcs are the helper functions available to every template.
+// csrfField needs the request, it is only a placeholder until Render replaces it
+var funcs = template.FuncMap{
+	"cents": formatCents,
+	"csrfField": func() (template.HTML, error) {
+		return "", errors.New("views: csrfField is only available through Render")
+	},
+}
+
+// formatCents formats an amount in integer cents as dollars, e.g. 1999 becomes "$19.99"
+func formatCents(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s$%d.%02d", sign, cents/100, cents%100)
+}
+
 type View struct {
 	Template 	*template.Template
 	Layout		string
 }
 
-func (v *View) Render(w http.ResponseWriter, data interface{}) {
+// Render executes the layout with data, wrapping it in Data if needed.
+// The signed in user is taken from the request context so every layout can use it,
+// and the CSRF token of the request is made available to forms through csrfField
+func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{}) {
 	w.Header().Set("Content-Type", "text/html")
-	switch data.(type) {
+	var vd Data
+	switch d := data.(type) {
 	case Data:
-		// do nothing
+		vd = d
 	default:
-		data = Data{
+		vd = Data{
 			Yield: data,
 		}
 	}
+	vd.User = context.User(r.Context())
+	vd.CSRFToken = csrf.Token(r)
+
+	tpl, err := v.Template.Clone()
+	if err != nil {
+		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
+		return
+	}
+	tpl.Funcs(template.FuncMap{
+		"csrfField": func() template.HTML {
+			return csrf.TemplateField(r)
+		},
+	})
 
 	var buf bytes.Buffer
-	err := v.Template.ExecuteTemplate(&buf, v.Layout, data)
+	err = tpl.ExecuteTemplate(&buf, v.Layout, vd)
 	if err != nil {
 		http.Error(w, "Something went wrong...", http.StatusInternalServerError)
 		return
@@ -41,7 +82,7 @@ func (v *View) Render(w http.ResponseWriter, data interface{}) {
 }
 
 func (v *View) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	v.Render(w, nil)
+	v.Render(w, r, nil)
 }
 
 func layoutFiles() []string {
@@ -70,7 +111,7 @@ func NewView(layout string, files ...string) *View {
 	addTemplateExt(files)
 
 	files = append(files, layoutFiles()...)
-	t, err := template.ParseFiles(files...)
+	t, err := template.New("").Funcs(funcs).ParseFiles(files...)
 	if err != nil {
 		panic(err)
 	}